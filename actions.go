@@ -16,8 +16,9 @@ import (
 )
 
 var (
-	tabActions = map[string]tabAction{}
-	urlActions = map[string]urlAction{}
+	tabActions      = map[string]tabAction{}
+	urlActions      = map[string]urlAction{}
+	bookmarkActions = map[string]bookmarkAction{}
 )
 
 type tabAction interface {
@@ -32,18 +33,75 @@ type urlAction interface {
 	Run(URL string) error
 }
 
+type bookmarkAction interface {
+	Name() string
+	Icon() *aw.Icon
+	Run(bookmarkID string) error
+}
+
+// pickerAction is implemented by actions that need the user to choose a
+// target, such as a window, before they can run. Picker returns the name
+// of the list the actions command shows to make the choice, or "" if the
+// action can run straight away.
+type pickerAction interface {
+	Picker() string
+}
+
 func init() {
 	for _, a := range []tabAction{
 		tAction{name: "Activate Tab", action: "activate", icon: iconTab},
 		tAction{name: "Close Tabs to Left", action: "close-left", icon: iconTab},
 		tAction{name: "Close Tabs to Right", action: "close-right", icon: iconTab},
 		tAction{name: "Close Other Tabs", action: "close-other", icon: iconTab},
+		tAction{name: "Close Tab", action: "close", icon: iconTab},
+		tAction{name: "Duplicate Tab", action: "duplicate", icon: iconTab},
+		tAction{name: "Reload Tab", action: "reload", icon: iconTab},
+		tAction{name: "Reload Tab (Bypass Cache)", action: "reload-bypass", icon: iconTab},
+		tAction{name: "Pin Tab", action: "pin", icon: iconTab},
+		tAction{name: "Unpin Tab", action: "unpin", icon: iconTab},
+		tAction{name: "Mute Tab", action: "mute", icon: iconTab},
+		tAction{name: "Unmute Tab", action: "unmute", icon: iconTab},
+		tAction{name: "Unload Tab", action: "discard", icon: iconTab},
+		tAction{name: "Move Tab to New Window", action: "move-new-window", icon: iconTab},
+		tAction{name: "Close Duplicate Tabs", action: "dedupe", icon: iconTab},
+		tAction{name: "Move Tab to Window…", action: "move-window", icon: iconTab, picker: "window"},
+		tAction{name: "Sort Tabs by Domain", action: "sort-domain", icon: iconTab},
+		tAction{name: "Sort Tabs by Title", action: "sort-title", icon: iconTab},
+		tAction{name: "Sort Tabs by Last Used", action: "sort-last-used", icon: iconTab},
+		tAction{name: "Gather Tabs from This Domain", action: "gather", icon: iconTab},
+		tAction{name: "Reopen Tab in Container…", action: "reopen-container", icon: iconTab, picker: "container"},
+		tAction{name: "Bookmark Tab…", action: "bookmark", icon: iconBookmark, picker: "folder"},
+		tAction{name: "Copy All Tabs as Markdown", action: "copy-all-markdown", icon: iconTab},
+		tAction{name: "Copy Window Tabs as Markdown", action: "copy-window-markdown", icon: iconTab},
 	} {
 		tabActions[a.Name()] = a
 	}
 
-	a := openIncognito{}
-	urlActions[a.Name()] = a
+	for _, a := range []bookmarkAction{
+		bAction{name: "Rename Bookmark…", action: "rename", picker: "title",
+			mods: []aw.ModKey{aw.ModCmd, aw.ModOpt}},
+		bAction{name: "Edit Bookmark URL…", action: "edit-url", picker: "url",
+			mods: []aw.ModKey{aw.ModCmd, aw.ModShift}},
+		bAction{name: "Move Bookmark to Folder…", action: "move", picker: "folder",
+			mods: []aw.ModKey{aw.ModCmd, aw.ModCtrl}},
+		bAction{name: "Delete Bookmark", action: "delete",
+			mods: []aw.ModKey{aw.ModCmd, aw.ModOpt, aw.ModCtrl}},
+	} {
+		bookmarkActions[a.Name()] = a
+	}
+
+	for _, a := range []urlAction{
+		openIncognito{},
+		openURL{name: "Open in Firefox", target: openNewTab},
+		openURL{name: "Open in Background Tab", target: openBackgroundTab},
+		openURL{name: "Open in Current Tab", target: openCurrentTab},
+		openURL{name: "Open in New Window", target: openNewWindow},
+		openURL{name: "Open in Window…", target: openNewTab, picker: "window"},
+		openURL{name: "Open in Container…", target: openNewTab, picker: "container"},
+		downloadWithBrowser{},
+	} {
+		urlActions[a.Name()] = a
+	}
 }
 
 func loadURLActions() error {
@@ -96,25 +154,133 @@ type tAction struct {
 	name   string
 	icon   *aw.Icon
 	action string
+	picker string // list to choose target from; see pickerAction
 }
 
 func (a tAction) Name() string   { return a.name }
 func (a tAction) Icon() *aw.Icon { return a.icon }
+func (a tAction) Picker() string { return a.picker }
 func (a tAction) Run(tabID int) error {
 	c := mustClient()
 	switch a.action {
 	case "activate":
-		_, err := util.RunAS(fmt.Sprintf(`tell application "%s" to activate`, c.appName))
-		if err != nil {
+		if err := activateBrowser(c); err != nil {
 			return err
 		}
 		return c.ActivateTab(tabID)
 	case "close-left":
-		return c.CloseTabsLeft(tabID)
+		return closeWithUndo(c, a.name, func() error { return c.CloseTabsLeft(tabID) })
 	case "close-right":
-		return c.CloseTabsRight(tabID)
+		return closeWithUndo(c, a.name, func() error { return c.CloseTabsRight(tabID) })
 	case "close-other":
-		return c.CloseTabsOther(tabID)
+		return closeWithUndo(c, a.name, func() error { return c.CloseTabsOther(tabID) })
+	case "close":
+		return c.CloseTab(tabID)
+	case "duplicate":
+		_, err := c.DuplicateTab(tabID)
+		return err
+	case "reload":
+		return c.ReloadTab(tabID, false)
+	case "reload-bypass":
+		return c.ReloadTab(tabID, true)
+	case "pin", "unpin":
+		return c.PinTab(tabID, a.action == "pin")
+	case "mute", "unmute":
+		return c.MuteTab(tabID, a.action == "mute")
+	case "discard":
+		return c.DiscardTab(tabID)
+	case "dedupe":
+		var n int
+		err := closeWithUndo(c, a.name, func() (err error) {
+			n, err = closeDuplicateTabs(c, true)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Closed %s\n", pluralise(n, "duplicate tab", "duplicate tabs"))
+		return nil
+	case "move-new-window":
+		return c.MoveTabToWindow(tabID, 0)
+	case "move-window":
+		// windowID is set by the window picker; 0 means a new window
+		return c.MoveTabToWindow(tabID, windowID)
+	case "sort-domain":
+		return sortWindowTabs(c, tabID, sortByDomain)
+	case "sort-title":
+		return sortWindowTabs(c, tabID, sortByTitle)
+	case "sort-last-used":
+		return sortWindowTabs(c, tabID, sortByLastUsed)
+	case "gather":
+		return gatherDomainTabs(c, tabID)
+	case "bookmark":
+		// folderID is set by the folder picker
+		tab, err := c.Tab(tabID)
+		if err != nil {
+			return err
+		}
+		bm, err := c.CreateBookmark(CreateBookmarkArg{ParentID: folderID, Title: tab.Title, URL: tab.URL})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Bookmarked “%s”\n", bm.Title)
+		return nil
+	case "copy-all-markdown":
+		return copyTabsMarkdown(c, 0)
+	case "copy-window-markdown":
+		tab, err := c.Tab(tabID)
+		if err != nil {
+			return err
+		}
+		return copyTabsMarkdown(c, tab.WindowID)
+	case "reopen-container":
+		// containerID is set by the container picker
+		_, err := c.ReopenTabInContainer(tabID, containerID)
+		return err
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
+
+type bAction struct {
+	name   string
+	action string
+	picker string      // list to choose folder or enter text; see pickerAction
+	mods   []aw.ModKey // keys to run action on bookmark results
+}
+
+func (a bAction) Name() string   { return a.name }
+func (a bAction) Icon() *aw.Icon { return iconBookmark }
+func (a bAction) Picker() string { return a.picker }
+func (a bAction) Run(bookmarkID string) error {
+	c := mustClient()
+	switch a.action {
+	case "rename":
+		// title is set by the title picker
+		_, err := c.UpdateBookmark(UpdateBookmarkArg{ID: bookmarkID, Title: title})
+		return err
+	case "edit-url":
+		// URL is set by the URL picker
+		_, err := c.UpdateBookmark(UpdateBookmarkArg{ID: bookmarkID, URL: URL})
+		return err
+	case "move":
+		// folderID is set by the folder picker
+		_, err := c.MoveBookmark(bookmarkID, folderID, -1)
+		return err
+	case "delete":
+		if err := c.DeleteBookmark(bookmarkID); err != nil {
+			return err
+		}
+		// title and URL are only set if action is run on a bookmark item
+		name := title
+		if name == "" {
+			name = URL
+		}
+		if name == "" {
+			name = "#" + bookmarkID
+		}
+		fmt.Printf("Deleted bookmark “%s”\n", name)
+		return nil
 	default:
 		return fmt.Errorf("unknown action %q", action)
 	}
@@ -151,12 +317,78 @@ type openIncognito struct{}
 func (a openIncognito) Name() string   { return "Open in Incognito Window" }
 func (a openIncognito) Icon() *aw.Icon { return iconIncognito }
 func (a openIncognito) Run(URL string) error {
-	mustClient().OpenIncognito(URL)
+	return mustClient().OpenIncognito(URL)
+}
+
+// URL action to download a URL with the browser, so its cookies are sent
+type downloadWithBrowser struct{}
+
+func (a downloadWithBrowser) Name() string   { return "Download with Firefox" }
+func (a downloadWithBrowser) Icon() *aw.Icon { return actionIcon(a.Name(), iconURL) }
+func (a downloadWithBrowser) Run(URL string) error {
+	dl, err := mustClient().DownloadURL(DownloadURLArg{URL: URL})
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(dl.Path)
+	if dl.Path == "" {
+		name = URL
+	}
+	fmt.Printf("Downloading “%s”\n", name)
 	return nil
 }
 
+// URL action to open a URL in the browser via the extension
+type openURL struct {
+	name   string
+	target string // one of the open* targets for OpenURL
+	picker string // list to choose window from; see pickerAction
+}
+
+func (a openURL) Name() string   { return a.name }
+func (a openURL) Icon() *aw.Icon { return actionIcon(a.name, iconTab) }
+func (a openURL) Picker() string { return a.picker }
+func (a openURL) Run(URL string) error {
+	c := mustClient()
+	arg := OpenURLArg{URL: URL, Target: a.target}
+	switch a.picker {
+	case "window":
+		// windowID is set by the window picker; 0 means a new window
+		if windowID == 0 {
+			arg.Target = openNewWindow
+		}
+		arg.WindowID = windowID
+	case "container":
+		// containerID is set by the container picker
+		arg.CookieStoreID = containerID
+	}
+	if _, err := c.OpenURL(arg); err != nil {
+		return err
+	}
+	if a.target == openBackgroundTab {
+		return nil
+	}
+	return activateBrowser(c)
+}
+
+// activateBrowser brings the browser the client is connected to to the front.
+func activateBrowser(c *rpcClient) error {
+	name, err := c.AppName()
+	if err != nil {
+		return err
+	}
+	_, err = util.RunAS(fmt.Sprintf(`tell application "%s" to activate`, name))
+	return err
+}
+
 var (
-	_ tabAction = (*tAction)(nil)
-	_ urlAction = (*uAction)(nil)
-	_ urlAction = openIncognito{}
+	_ tabAction      = (*tAction)(nil)
+	_ pickerAction   = tAction{}
+	_ bookmarkAction = bAction{}
+	_ pickerAction   = bAction{}
+	_ urlAction      = (*uAction)(nil)
+	_ urlAction      = openIncognito{}
+	_ urlAction      = downloadWithBrowser{}
+	_ urlAction      = openURL{}
+	_ pickerAction   = openURL{}
 )
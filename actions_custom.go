@@ -48,8 +48,16 @@ func (ca customAction) Add(it *aw.Item) {
 	switch ca.kind {
 	case "tab":
 		m.Icon(iconTab).Var("CMD", "tab")
+		// show list to choose target first
+		if a, ok := tabActions[ca.name].(pickerAction); ok && a.Picker() != "" {
+			m.Var("CMD", "actions").Var("PICKER", a.Picker())
+		}
 	case "url":
 		m.Var("CMD", "url").Icon(actionIcon(ca.name, iconURL))
+		// show list to choose target first
+		if a, ok := urlActions[ca.name].(pickerAction); ok && a.Picker() != "" {
+			m.Var("CMD", "actions").Var("PICKER", a.Picker())
+		}
 	case "bookmarklet":
 		m.Var("CMD", "run-bookmarklet").Var("BOOKMARK", ca.id).
 			Icon(actionIcon(ca.name, iconBookmarklet))
@@ -0,0 +1,371 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+var (
+	// run a bookmark action
+	bookmarkCmd = &ffcli.Command{
+		Name:      "bookmark",
+		Usage:     "alfred-firefox -bookmark <id> -action <name> [-title <title>] [-url <url>] [-folder <id>] bookmark",
+		ShortHelp: "execute bookmark action",
+		LongHelp: wrap(`
+			Rename, edit the URL of, move or delete the specified
+			bookmark. The new title, URL or folder is passed via
+			the -title, -url or -folder flag.
+		`),
+		Exec: runBookmarkAction,
+	}
+
+	// browse bookmark folders
+	browseBookmarksCmd = &ffcli.Command{
+		Name:      "browse-bookmarks",
+		Usage:     "alfred-firefox [-query <folder>/<query>] browse-bookmarks",
+		ShortHelp: "browse bookmark folders",
+		LongHelp: wrap(`
+			Navigate bookmark folders like a file browser. The query is
+			a folder path optionally followed by a search query,
+			e.g. "Bookmarks Toolbar/Go/docs".
+		`),
+		Exec: runBrowseBookmarks,
+	}
+)
+
+// ID of the bookmarks root folder, which contains the toolbar, menu etc.
+const rootBookmarkID = "root________"
+
+// bookmarkTree indexes bookmarks and folders by ID and parent, so that
+// the folder path of a bookmark can be resolved.
+type bookmarkTree struct {
+	nodes    map[string]Bookmark
+	children map[string][]Bookmark // keyed by folder ID
+	paths    map[string]string     // cache for folderPath
+}
+
+// newBookmarkTree creates a bookmarkTree from all bookmarks and folders.
+func newBookmarkTree(nodes []Bookmark) *bookmarkTree {
+	t := &bookmarkTree{
+		nodes:    map[string]Bookmark{},
+		children: map[string][]Bookmark{},
+		paths:    map[string]string{rootBookmarkID: ""},
+	}
+	for _, bm := range nodes {
+		t.nodes[bm.ID] = bm
+		t.children[bm.ParentID] = append(t.children[bm.ParentID], bm)
+	}
+	for _, kids := range t.children {
+		sort.SliceStable(kids, func(i, j int) bool { return kids[i].Index < kids[j].Index })
+	}
+	return t
+}
+
+// path returns the path of the folder containing the bookmark or folder with
+// the given ID, e.g. "Bookmarks Toolbar/Go". It returns an empty string for
+// top-level folders and unknown IDs.
+func (t *bookmarkTree) path(id string) string {
+	bm, ok := t.nodes[id]
+	if !ok {
+		return ""
+	}
+	return t.folderPath(bm.ParentID)
+}
+
+// folderPath returns the full path of the folder with the given ID.
+func (t *bookmarkTree) folderPath(id string) string {
+	if p, ok := t.paths[id]; ok {
+		return p
+	}
+	folder, ok := t.nodes[id]
+	if !ok {
+		return ""
+	}
+	// mark as visited in case of cycles
+	t.paths[id] = ""
+	p := folder.Title
+	if parent := t.folderPath(folder.ParentID); parent != "" {
+		p = parent + "/" + p
+	}
+	t.paths[id] = p
+	return p
+}
+
+// folder returns the folder with the given path, which is matched
+// case-insensitively. An empty path returns the root folder.
+func (t *bookmarkTree) folder(path string) (Bookmark, bool) {
+	id := rootBookmarkID
+	for _, name := range splitBookmarkPath(path) {
+		var found bool
+		for _, bm := range t.children[id] {
+			if bm.Type == "folder" && strings.EqualFold(bm.Title, name) {
+				id, found = bm.ID, true
+				break
+			}
+		}
+		if !found {
+			return Bookmark{}, false
+		}
+	}
+	return Bookmark{ID: id, Type: "folder", Path: t.path(id), Title: t.nodes[id].Title}, true
+}
+
+// contents returns the bookmarks and folders in a folder in order.
+func (t *bookmarkTree) contents(folderID string) []Bookmark {
+	return t.children[folderID]
+}
+
+// splitBookmarkPath splits a folder path into folder names, ignoring
+// empty names.
+func splitBookmarkPath(path string) []string {
+	var names []string
+	for _, s := range strings.Split(path, "/") {
+		if s = strings.TrimSpace(s); s != "" {
+			names = append(names, s)
+		}
+	}
+	return names
+}
+
+// inFolder returns true if path is the same as or inside folder. folder
+// matches any run of whole folder names in path, case-insensitively, so
+// "go/docs" matches "Bookmarks Toolbar/Go/Docs/Stdlib".
+func inFolder(path, folder string) bool {
+	var (
+		have = splitBookmarkPath(strings.ToLower(path))
+		want = splitBookmarkPath(strings.ToLower(folder))
+	)
+	if len(want) == 0 {
+		return true
+	}
+outer:
+	for i := 0; i+len(want) <= len(have); i++ {
+		for j, name := range want {
+			if have[i+j] != name {
+				continue outer
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// bookmarkQuery is a bookmark search query parsed by parseBookmarkQuery.
+type bookmarkQuery struct {
+	Folder  string   // from in:<folder>
+	Tags    []string // from #<tag>
+	Keyword string   // from kw:<keyword>
+	Text    string   // rest of query, searched for by Firefox
+}
+
+// filtered returns true if query filters by folder, tag or keyword.
+func (bq bookmarkQuery) filtered() bool {
+	return bq.Folder != "" || len(bq.Tags) > 0 || bq.Keyword != ""
+}
+
+// match returns true if bookmark is in the query's folder and has all its
+// tags and a keyword starting with its keyword. Tags and keywords are matched
+// case-insensitively.
+func (bq bookmarkQuery) match(bm Bookmark) bool {
+	if !inFolder(bm.Path, bq.Folder) {
+		return false
+	}
+	if !strings.HasPrefix(strings.ToLower(bm.Keyword), strings.ToLower(bq.Keyword)) {
+		return false
+	}
+outer:
+	for _, want := range bq.Tags {
+		for _, tag := range bm.Tags {
+			if strings.EqualFold(tag, want) {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// parseBookmarkQuery splits "in:<folder>", "#<tag>" and "kw:<keyword>"
+// filters from the rest of query. Values containing spaces must be quoted,
+// e.g. in:"Bookmarks Toolbar/Go" or #"read later".
+func parseBookmarkQuery(q string) bookmarkQuery {
+	var (
+		bq    bookmarkQuery
+		words []string
+	)
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+		var word string
+		word, q = nextQueryWord(q)
+		switch lower := strings.ToLower(word); {
+		case strings.HasPrefix(lower, "in:"):
+			bq.Folder = unquote(word[3:])
+		case strings.HasPrefix(lower, "kw:"):
+			bq.Keyword = unquote(word[3:])
+		case len(word) > 1 && word[0] == '#':
+			if tag := unquote(word[1:]); tag != "" {
+				bq.Tags = append(bq.Tags, tag)
+			}
+		default:
+			words = append(words, word)
+		}
+	}
+	bq.Text = strings.Join(words, " ")
+	return bq
+}
+
+// nextQueryWord splits the first word from q. Whitespace between double
+// quotes doesn't end a word.
+func nextQueryWord(q string) (word, rest string) {
+	var quoted bool
+	for i, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t'):
+			return q[:i], q[i:]
+		}
+	}
+	return q, ""
+}
+
+// unquote removes double quotes around s.
+func unquote(s string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(s, `"`), `"`)
+}
+
+// bookmarkPickerArg returns the query to start a bookmark action's picker
+// with, i.e. the current value of the field it changes.
+func bookmarkPickerArg(a bookmarkAction, bm Bookmark) string {
+	pa, ok := a.(pickerAction)
+	if !ok {
+		return ""
+	}
+	switch pa.Picker() {
+	case "title":
+		return bm.Title
+	case "url":
+		return bm.URL
+	default:
+		return ""
+	}
+}
+
+// run an action on a bookmark
+func runBookmarkAction(_ []string) error {
+	useTextErrors()
+	if bookmarkID == "" {
+		return errors.New("no bookmark ID")
+	}
+	log.Printf("running action %q on bookmark %q ...", action, bookmarkID)
+	a, ok := bookmarkActions[action]
+	if !ok {
+		return fmt.Errorf("unknown action %q", action)
+	}
+	return a.Run(bookmarkID)
+}
+
+// navigate bookmark folders
+func runBrowseBookmarks(_ []string) error {
+	checkForUpdate()
+	nodes, err := mustClient().BookmarkTree()
+	if err != nil {
+		return err
+	}
+	tree := newBookmarkTree(nodes)
+
+	// query is "<folder path>/<query>"
+	dir, q := "", query
+	if i := strings.LastIndex(query, "/"); i > -1 {
+		dir, q = query[:i], query[i+1:]
+	}
+	folder, ok := tree.folder(dir)
+	if !ok {
+		wf.NewWarningItem("Unknown Folder", dir).
+			Autocomplete("")
+		wf.SendFeedback()
+		return nil
+	}
+
+	log.Printf("browsing bookmark folder %q for %q ...", dir, q)
+	prefix := tree.folderPath(folder.ID)
+	if prefix != "" {
+		prefix += "/"
+	}
+	if folder.ID != rootBookmarkID && q == "" {
+		up, sub := "", "Go up to top level"
+		if folder.Path != "" {
+			up, sub = folder.Path+"/", "Go up to "+folder.Path
+		}
+		wf.NewItem("..").
+			Subtitle(sub).
+			Autocomplete(up).
+			Icon(iconFolder)
+	}
+
+	custom := loadCustomActions()
+	for _, bm := range tree.contents(folder.ID) {
+		if bm.Type == "folder" {
+			wf.NewItem(bm.Title).
+				Subtitle(pluralise(len(tree.contents(bm.ID)), "item", "items")).
+				Match(bm.Title).
+				Autocomplete(prefix + bm.Title + "/").
+				UID(bm.ID).
+				Icon(iconFolder)
+			continue
+		}
+		if bm.URL == "" || bm.IsBookmarklet() {
+			continue
+		}
+		bookmarkItem(bm, custom).Match(bm.Title)
+	}
+
+	if q != "" {
+		_ = wf.Filter(q)
+	}
+
+	wf.WarnEmpty("No Bookmarks", "Folder is empty or nothing matches")
+	wf.SendFeedback()
+	return nil
+}
+
+// list bookmark folders to add tab to or move bookmark to
+func pickFolder() error {
+	c := mustClient()
+	if _, _, err := pickerTab(c); err != nil {
+		return err
+	}
+	nodes, err := c.BookmarkTree()
+	if err != nil {
+		return err
+	}
+
+	var current string // folder bookmark is already in
+	if _, ok := bookmarkActions[action]; ok {
+		for _, bm := range nodes {
+			if bm.ID == bookmarkID {
+				current = bm.ParentID
+			}
+		}
+	}
+	for _, bm := range nodes {
+		if bm.Type != "folder" || bm.ID == current {
+			continue
+		}
+		p := bm.Title
+		if bm.Path != "" {
+			p = bm.Path + "/" + p
+		}
+		pickerItem(bm.Title, p, bm.ID, iconFolder).
+			Match(p).
+			Var("FOLDER", bm.ID)
+	}
+	return nil
+}
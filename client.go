@@ -7,9 +7,12 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 
 	aw "github.com/deanishe/awgo"
 	"github.com/deanishe/awgo/util"
@@ -40,8 +43,11 @@ var (
 		Name:      "bookmarks",
 		Usage:     "alfred-firefox -query <query> bookmarks",
 		ShortHelp: "search bookmarks",
-		LongHelp:  wrap(`Search browser bookmarks.`),
-		Exec:      runBookmarks,
+		LongHelp: wrap(`
+			Search browser bookmarks. Add in:<folder> to the query to
+			only show bookmarks in that folder, e.g. "in:Go/Docs net".
+		`),
+		Exec: runBookmarks,
 	}
 
 	// search bookmarklets
@@ -199,21 +205,32 @@ func init() {
 // search Firefox history
 func runHistory(_ []string) error {
 	checkForUpdate()
-	if len(query) < 3 {
+	hq, err := parseHistoryQuery(query, time.Now())
+	if err != nil {
+		wf.Warn("Invalid Query", err.Error())
+		return nil
+	}
+	if !hq.filtered() && len(hq.Text) < 3 {
 		wf.Warn("Query Too Short", "Please enter at least 3 characters")
 		return nil
 	}
 
-	log.Printf("searching bookmarks for %q ...", query)
-	history, err := mustClient().History(query)
+	log.Printf("searching history for %q on site %q between %v and %v ...",
+		hq.Text, hq.Site, hq.Since, hq.Before)
+	history, err := mustClient().SearchHistory(hq.arg())
 	if err != nil {
 		return err
 	}
 
 	custom := loadCustomActions()
 	for _, h := range history {
+		if !hq.match(h) {
+			continue
+		}
+		sub := fmt.Sprintf("Visited %s · %s · %s", relativeTime(h.LastVisit()),
+			pluralise(h.VisitCount, "visit", "visits"), h.URL)
 		it := wf.NewItem(h.Title).
-			Subtitle(h.URL).
+			Subtitle(sub).
 			Arg(h.URL).
 			UID(h.ID).
 			Valid(true).
@@ -229,6 +246,29 @@ func runHistory(_ []string) error {
 			Icon(iconMore).
 			Var("CMD", "actions")
 
+		it.NewModifier(aw.ModCmd, aw.ModOpt).
+			Subtitle("Delete from History").
+			Arg("").
+			Icon(iconHistory).
+			Var("CMD", "forget").
+			Var("ACTION", "delete-url")
+
+		it.NewModifier(aw.ModCmd, aw.ModShift).
+			Subtitle("Show Visits…").
+			Arg(h.URL).
+			Icon(iconHistory).
+			Var("CMD", "actions").
+			Var("PICKER", "visits")
+
+		if host := urlHost(h.URL); host != "" {
+			it.NewModifier(aw.ModCmd, aw.ModCtrl).
+				Subtitle("Forget This Site…").
+				Arg(host).
+				Icon(iconHistory).
+				Var("CMD", "actions").
+				Var("PICKER", "forget")
+		}
+
 		custom.Add(it, false)
 	}
 
@@ -240,40 +280,35 @@ func runHistory(_ []string) error {
 // search Firefox bookmarks
 func runBookmarks(_ []string) error {
 	checkForUpdate()
-	if len(query) < 3 {
+	bq := parseBookmarkQuery(query)
+	if !bq.filtered() && len(bq.Text) < 3 {
 		wf.Warn("Query Too Short", "Please enter at least 3 characters")
 		return nil
 	}
 
-	log.Printf("searching bookmarks for %q ...", query)
-	bookmarks, err := mustClient().Bookmarks(query)
+	log.Printf("searching bookmarks for %q in folder %q with tags %v and keyword %q ...",
+		bq.Text, bq.Folder, bq.Tags, bq.Keyword)
+	bookmarks, err := mustClient().Bookmarks(bq.Text)
 	if err != nil {
 		return err
 	}
 
+	meta, err := loadPlacesMeta()
+	if err != nil {
+		if len(bq.Tags) > 0 || bq.Keyword != "" {
+			return fmt.Errorf("read bookmark tags: %v", err)
+		}
+		log.Printf("[WARNING] read bookmark tags: %v", err)
+	}
+
 	custom := loadCustomActions()
 	for _, bm := range bookmarks {
-		if bm.IsBookmarklet() {
+		m := meta[bm.ID]
+		bm.Tags, bm.Keyword = m.Tags, m.Keyword
+		if bm.IsBookmarklet() || !bq.match(bm) {
 			continue
 		}
-		it := wf.NewItem(bm.Title).
-			Subtitle(bm.URL).
-			Arg(bm.URL).
-			UID(bm.ID).
-			Valid(true).
-			Icon(iconBookmark).
-			Var("CMD", "url").
-			Var("ACTION", urlDefault).
-			Var("URL", bm.URL).
-			Var("TITLE", bm.Title)
-
-		it.NewModifier(aw.ModCmd).
-			Subtitle("Other Actions…").
-			Arg("").
-			Icon(iconMore).
-			Var("CMD", "actions")
-
-		custom.Add(it, false)
+		bookmarkItem(bm, custom)
 	}
 
 	wf.WarnEmpty("No Results", "Try a different query?")
@@ -281,6 +316,57 @@ func runBookmarks(_ []string) error {
 	return nil
 }
 
+// bookmarkItem adds an Alfred item for bookmark.
+func bookmarkItem(bm Bookmark, custom customActions) *aw.Item {
+	var parts []string
+	if bm.Path != "" {
+		parts = append(parts, bm.Path)
+	}
+	if len(bm.Tags) > 0 {
+		parts = append(parts, "#"+strings.Join(bm.Tags, " #"))
+	}
+	if bm.Keyword != "" {
+		parts = append(parts, "kw:"+bm.Keyword)
+	}
+	sub := strings.Join(append(parts, bm.URL), " · ")
+	it := wf.NewItem(bm.Title).
+		Subtitle(sub).
+		Arg(bm.URL).
+		UID(bm.ID).
+		Valid(true).
+		Icon(iconBookmark).
+		Var("CMD", "url").
+		Var("ACTION", urlDefault).
+		Var("URL", bm.URL).
+		Var("TITLE", bm.Title).
+		Var("BOOKMARK", bm.ID)
+
+	it.NewModifier(aw.ModCmd).
+		Subtitle("Other Actions…").
+		Arg("").
+		Icon(iconMore).
+		Var("CMD", "actions")
+
+	for _, a := range bookmarkActions {
+		ba, ok := a.(bAction)
+		if !ok || len(ba.mods) == 0 {
+			continue
+		}
+		m := it.NewModifier(ba.mods...).
+			Subtitle(a.Name()).
+			Arg(bookmarkPickerArg(a, bm)).
+			Icon(a.Icon()).
+			Var("CMD", "bookmark").
+			Var("ACTION", a.Name())
+		if ba.picker != "" {
+			m.Var("CMD", "actions").Var("PICKER", ba.picker)
+		}
+	}
+
+	custom.Add(it, false)
+	return it
+}
+
 // search Firefox bookmarklets
 func runBookmarklets(_ []string) error {
 	checkForUpdate()
@@ -317,35 +403,104 @@ func runBookmarklets(_ []string) error {
 
 // execute a bookmarklet in a tab
 func runBookmarklet(_ []string) error {
-	wf.Configure(aw.TextErrors(true))
+	useTextErrors()
 	log.Printf("running bookmarklet %q in tab #%d ...", bookmarkID, tabID)
 
 	return mustClient().
 		RunBookmarklet(RunBookmarkletArg{BookmarkID: bookmarkID, TabID: tabID})
 }
 
+// tabFilters are query prefixes that restrict the tabs shown by the tabs
+// command, e.g. "audible: youtube".
+var tabFilters = map[string]func(t Tab) bool{
+	"active:":    func(t Tab) bool { return t.Active },
+	"audible:":   func(t Tab) bool { return t.Audible },
+	"muted:":     func(t Tab) bool { return t.Muted },
+	"pinned:":    func(t Tab) bool { return t.Pinned },
+	"discarded:": func(t Tab) bool { return t.Discarded },
+	"private:":   func(t Tab) bool { return t.Incognito },
+	"incognito:": func(t Tab) bool { return t.Incognito },
+}
+
+// parseTabQuery splits any tabFilters prefixes from the rest of the query.
+func parseTabQuery(q string) (filters []func(Tab) bool, rest string) {
+	var words []string
+	for _, s := range strings.Fields(q) {
+		if fn, ok := tabFilters[strings.ToLower(s)]; ok {
+			filters = append(filters, fn)
+			continue
+		}
+		words = append(words, s)
+	}
+	return filters, strings.Join(words, " ")
+}
+
 // filter open Firefox tabs
 func runTabs(_ []string) error {
 	log.Printf("fetching tabs for query %q ...", query)
 	checkForUpdate()
 
 	var (
+		c    = mustClient()
 		tabs []Tab
 		err  error
 	)
-	if tabs, err = mustClient().Tabs(); err != nil {
+	if tabs, err = c.Tabs(); err != nil {
 		return err
 	}
 
-	custom := loadCustomActions()
+	var (
+		filters, q = parseTabQuery(query)
+		custom     = loadCustomActions()
+		containers = tabContainers(c, tabs)
+		missing    []string // favicons that need downloading
+	)
+tabs:
 	for _, t := range tabs {
-		id := fmt.Sprintf("%d", t.ID)
-		it := wf.NewItem(t.Title).
-			Subtitle(t.URL).
+		for _, fn := range filters {
+			if !fn(t) {
+				continue tabs
+			}
+		}
+
+		var (
+			id    = fmt.Sprintf("%d", t.ID)
+			title = t.Title
+			sub   = t.URL
+			icon  = iconTab
+		)
+		switch {
+		case t.Muted:
+			title = "🔇 " + title
+		case t.Audible:
+			title = "🔊 " + title
+		}
+		if t.Pinned {
+			title = "📌 " + title
+		}
+		if t.Discarded {
+			sub = "(unloaded) " + sub
+		}
+		if ct, ok := containers[t.CookieStoreID]; ok {
+			sub = containerLabel(ct) + " · " + sub
+		}
+		if t.Incognito {
+			// don't store anything from private tabs on disk
+			icon = iconIncognito
+			sub = "Private · " + sub
+		} else if fi, ok := favicon(t.FaviconURL); !ok {
+			missing = append(missing, t.FaviconURL)
+		} else if fi != nil {
+			icon = fi
+		}
+
+		it := wf.NewItem(title).
+			Subtitle(sub).
+			Match(t.Title).
 			Arg(t.URL).
 			UID(t.Title).
 			Valid(true).
-			Icon(iconTab).
+			Icon(icon).
 			Var("CMD", "tab").
 			Var("ACTION", "Activate Tab").
 			Var("TAB", id).
@@ -360,9 +515,10 @@ func runTabs(_ []string) error {
 
 		custom.Add(it, true)
 	}
+	fetchFavicons(missing)
 
-	if query != "" {
-		_ = wf.Filter(query)
+	if q != "" {
+		_ = wf.Filter(q)
 	}
 
 	wf.WarnEmpty("No Matching Tabs", "Try a different query?")
@@ -370,9 +526,30 @@ func runTabs(_ []string) error {
 	return nil
 }
 
+// emoji for container colours
+var containerColours = map[string]string{
+	"blue":      "🔵",
+	"turquoise": "🩵",
+	"green":     "🟢",
+	"yellow":    "🟡",
+	"orange":    "🟠",
+	"red":       "🔴",
+	"pink":      "🩷",
+	"purple":    "🟣",
+	"toolbar":   "⚪️",
+}
+
+// pluralise returns "<n> <singular>" or "<n> <plural>".
+func pluralise(n int, singular, plural string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, singular)
+	}
+	return fmt.Sprintf("%d %s", n, plural)
+}
+
 // execute a tab or URL action on the given tab
 func runTabAction(_ []string) error {
-	wf.Configure(aw.TextErrors(true))
+	useTextErrors()
 	// load tab info so we can also run URL actions
 	tab, err := mustClient().Tab(tabID)
 	if err != nil {
@@ -391,7 +568,7 @@ func runTabAction(_ []string) error {
 
 // run an action on a URL
 func runURLAction(_ []string) error {
-	_ = wf.Configure(aw.TextErrors(true))
+	useTextErrors()
 	if URL == "" {
 		tab, err := mustClient().Tab(0)
 		if err != nil {
@@ -409,7 +586,7 @@ func runURLAction(_ []string) error {
 
 // export variables containing info for currently-active tab
 func runCurrentTabInfo(_ []string) error {
-	_ = wf.Configure(aw.TextErrors(true))
+	useTextErrors()
 	tab, err := mustClient().Tab(0)
 	if err != nil {
 		return err
@@ -445,7 +622,7 @@ func runCurrentTab(_ []string) error {
 // inject JavaScript into specified tab. If tabID is 0, JS in injected
 // into the active tab.
 func runInject(args []string) error {
-	_ = wf.Configure(aw.TextErrors(true))
+	useTextErrors()
 	if len(args) != 1 {
 		return fmt.Errorf("inject command takes 1 argument, not %d", len(args))
 	}
@@ -459,9 +636,13 @@ func runInject(args []string) error {
 
 // filter actions for tab or URL
 func runActions(_ []string) error {
+	if picker != "" {
+		return runPicker()
+	}
+
 	if tabID != 0 {
 		for _, a := range tabActions {
-			wf.NewItem(a.Name()).
+			it := wf.NewItem(a.Name()).
 				UID(a.Name()).
 				Copytext(a.Name()).
 				Icon(a.Icon()).
@@ -469,6 +650,11 @@ func runActions(_ []string) error {
 				Var("CMD", "tab").
 				Var("ACTION", a.Name()).
 				Var("TAB", fmt.Sprintf("%d", tabID))
+
+			// show list to choose target first
+			if pa, ok := a.(pickerAction); ok && pa.Picker() != "" {
+				it.Var("CMD", "actions").Var("PICKER", pa.Picker())
+			}
 		}
 
 		// add custom bookmarklet commands
@@ -487,12 +673,32 @@ func runActions(_ []string) error {
 		}
 	}
 
+	if bookmarkID != "" {
+		bm := Bookmark{ID: bookmarkID, Title: title, URL: URL}
+		for _, a := range bookmarkActions {
+			it := wf.NewItem(a.Name()).
+				UID(a.Name()).
+				Copytext(a.Name()).
+				Icon(a.Icon()).
+				Valid(true).
+				Arg(bookmarkPickerArg(a, bm)).
+				Var("CMD", "bookmark").
+				Var("ACTION", a.Name()).
+				Var("BOOKMARK", bookmarkID)
+
+			// show list to choose target or enter text first
+			if pa, ok := a.(pickerAction); ok && pa.Picker() != "" {
+				it.Var("CMD", "actions").Var("PICKER", pa.Picker())
+			}
+		}
+	}
+
 	if URL != "" {
 		for _, a := range urlActions {
 			if a.Name() == urlDefault {
 				continue
 			}
-			wf.NewItem(a.Name()).
+			it := wf.NewItem(a.Name()).
 				UID(a.Name()).
 				Copytext(a.Name()).
 				Icon(a.Icon()).
@@ -500,6 +706,11 @@ func runActions(_ []string) error {
 				Var("CMD", "url").
 				Var("ACTION", a.Name()).
 				Var("URL", URL)
+
+			// show list to choose target first
+			if pa, ok := a.(pickerAction); ok && pa.Picker() != "" {
+				it.Var("CMD", "actions").Var("PICKER", pa.Picker())
+			}
 		}
 	}
 
@@ -512,9 +723,110 @@ func runActions(_ []string) error {
 	return nil
 }
 
+// show list of targets for a pickerAction
+func runPicker() error {
+	switch picker {
+	case "window":
+		if err := pickWindow(); err != nil {
+			return err
+		}
+	case "container":
+		if err := pickContainer(); err != nil {
+			return err
+		}
+	case "folder":
+		if err := pickFolder(); err != nil {
+			return err
+		}
+	case "forget":
+		// shows confirmation, not a list of targets
+		return listForget()
+	case "visits":
+		return listVisits()
+	case "title", "url":
+		// query is the new value, so don't filter
+		pickText()
+		wf.SendFeedback()
+		return nil
+	default:
+		return fmt.Errorf("unknown picker %q", picker)
+	}
+
+	if query != "" {
+		_ = wf.Filter(query)
+	}
+
+	wf.WarnEmpty("No Matching Items", "Try a different query?")
+	wf.SendFeedback()
+	return nil
+}
+
+// pickerItem adds an item that runs the current action on the target
+// chosen from a picker. The caller sets the variable for the target.
+func pickerItem(title, sub, uid string, icon *aw.Icon) *aw.Item {
+	it := wf.NewItem(title).
+		Subtitle(sub).
+		UID(uid).
+		Valid(true).
+		Icon(icon).
+		Var("ACTION", action).
+		Var("PICKER", "")
+	if _, ok := tabActions[action]; ok {
+		it.Var("CMD", "tab").Var("TAB", fmt.Sprintf("%d", tabID))
+	} else if _, ok := bookmarkActions[action]; ok {
+		it.Var("CMD", "bookmark").Var("BOOKMARK", bookmarkID)
+	} else {
+		it.Var("CMD", "url").Var("URL", URL)
+	}
+	return it
+}
+
+// pickerTab returns the tab a picker's tab action will run on, or false if
+// the action is a URL action.
+func pickerTab(c *rpcClient) (tab Tab, ok bool, err error) {
+	if _, ok := tabActions[action]; !ok {
+		return Tab{}, false, nil
+	}
+	if tab, err = c.Tab(tabID); err != nil {
+		return Tab{}, false, err
+	}
+	tabID = tab.ID // resolve active tab
+	return tab, true, nil
+}
+
+// show an item to set a bookmark's title or URL to the query
+func pickText() {
+	var (
+		value = strings.TrimSpace(query)
+		name  = "Title"
+	)
+	if picker == "url" {
+		name = "URL"
+	}
+	if value == "" {
+		wf.NewItem("Enter New " + name).
+			Subtitle(action).
+			Icon(iconBookmark)
+		return
+	}
+	if picker == "url" {
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" {
+			wf.NewWarningItem("Invalid URL", "Enter a full URL, e.g. https://www.example.com/")
+			return
+		}
+	}
+
+	it := pickerItem(fmt.Sprintf("Set %s to “%s”", name, value), action, picker, iconBookmark)
+	if picker == "url" {
+		it.Var("URL", value)
+	} else {
+		it.Var("TITLE", value)
+	}
+}
+
 // check if a newer version of workflow is available
 func runUpdate(_ []string) error {
-	wf.Configure(aw.TextErrors(true))
+	useTextErrors()
 	log.Print("checking for update ...")
 	if err := wf.CheckForUpdate(); err != nil {
 		return err
@@ -525,6 +837,58 @@ func runUpdate(_ []string) error {
 	return nil
 }
 
+// showClientError sends an Alfred item explaining an error returned by
+// rpcClient. It returns false if err isn't an rpcClient error.
+func showClientError(err error) bool {
+	switch err := err.(type) {
+	case errNotRunning:
+		wf.NewItem("Can't Connect to Browser").
+			Subtitle("Is Firefox running with the extension enabled? ↩ to get extension").
+			Arg(addonURL).
+			Valid(true).
+			Icon(iconError).
+			Var("CMD", "url").
+			Var("ACTION", urlDefault).
+			Var("URL", addonURL)
+
+	case errConnectionLost:
+		wf.NewItem("Lost Connection to Browser").
+			Subtitle("The command may or may not have run. Try again.").
+			Icon(iconWarning).
+			Valid(false)
+
+	case errNoResponse:
+		wf.NewItem("Browser Not Responding").
+			Subtitle("The extension didn't respond. Try again or restart Firefox.").
+			Icon(iconWarning).
+			Valid(false)
+
+	case errCommandFailed:
+		if err.Err.Code == codeUnsupported {
+			wf.NewItem("Browser Extension Is Out of Date").
+				Subtitle("Update the extension to use this feature. ↩ to update.").
+				Arg(addonURL).
+				Valid(true).
+				Icon(iconUpdateAvailable).
+				Var("CMD", "url").
+				Var("ACTION", urlDefault).
+				Var("URL", addonURL)
+		} else {
+			wf.NewItem("Browser Error").
+				Subtitle(err.Err.Message).
+				Icon(iconError).
+				Valid(false)
+		}
+
+	default:
+		return false
+	}
+
+	log.Printf("[ERROR] %v", err)
+	wf.SendFeedback()
+	return true
+}
+
 // show workflow status and options
 func runStatus(_ []string) error {
 	if c, err := newClient(); err != nil {
@@ -537,9 +901,27 @@ func runStatus(_ []string) error {
 				Subtitle(err.Error()).
 				Icon(iconError)
 
+		} else if info, err := c.ExtensionInfo(); err == nil && info.Outdated() {
+			v := info.Version
+			if v == "" {
+				v = "unknown"
+			}
+			wf.NewItem("Browser Extension Is Out of Date").
+				Subtitle(fmt.Sprintf("Installed version is %s, workflow requires %s or newer. ↩ to update.",
+					v, minExtensionVersion)).
+				Arg(addonURL).
+				Valid(true).
+				Icon(iconUpdateAvailable).
+				Var("CMD", "url").
+				Var("ACTION", urlDefault).
+				Var("URL", addonURL)
 		} else {
+			sub := "Extension is installed and running"
+			if info.Version != "" {
+				sub = fmt.Sprintf("Extension v%s is installed and running", info.Version)
+			}
 			wf.NewItem("Connected to Browser").
-				Subtitle("Extension is installed and running")
+				Subtitle(sub)
 		}
 	}
 
@@ -615,17 +997,7 @@ func runDownloads(_ []string) error {
 	}
 
 	for _, dl := range downloads {
-		wf.NewItem(filepath.Base(dl.Path)).
-			Subtitle(util.PrettyPath(dl.Path)).
-			Arg(dl.Path).
-			UID(dl.Path).
-			IsFile(true).
-			Icon(&aw.Icon{Value: dl.Path, Type: aw.IconTypeFileIcon}).
-			Valid(true).
-			Var("CMD", "open").
-			NewModifier(aw.ModCmd).
-			Subtitle("Reveal in Finder").
-			Var("CMD", "reveal")
+		downloadItem(dl)
 	}
 
 	wf.WarnEmpty("Nothing Found", "Try a different query?")
@@ -0,0 +1,153 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+var (
+	// filter containers
+	containersCmd = &ffcli.Command{
+		Name:      "containers",
+		Usage:     "alfred-firefox [-query <query>] containers",
+		ShortHelp: "filter containers",
+		LongHelp:  wrap(`Filter containers and open new tabs in them.`),
+		Exec:      runContainers,
+	}
+
+	// run a container action
+	containerCmd = &ffcli.Command{
+		Name:      "container",
+		Usage:     "alfred-firefox -container <id> -action open container",
+		ShortHelp: "execute container action",
+		LongHelp:  wrap(`Open a new tab in the specified container.`),
+		Exec:      runContainerAction,
+	}
+)
+
+// tabContainers returns the containers of tabs keyed by ID. Errors are
+// logged, not returned, as containers are only used to annotate tabs.
+func tabContainers(c *rpcClient, tabs []Tab) map[string]Container {
+	m := map[string]Container{}
+	for _, t := range tabs {
+		if t.CookieStoreID != "" && t.CookieStoreID != defaultContainer && !t.Incognito {
+			containers, err := c.Containers()
+			if err != nil {
+				log.Printf("[ERROR] containers: %v", err)
+				return m
+			}
+			for _, ct := range containers {
+				m[ct.ID] = ct
+			}
+			return m
+		}
+	}
+	return m
+}
+
+// containerLabel returns container's name prefixed with its colour.
+func containerLabel(ct Container) string {
+	if s, ok := containerColours[ct.Color]; ok {
+		return s + " " + ct.Name
+	}
+	return ct.Name
+}
+
+// filter containers
+func runContainers(_ []string) error {
+	log.Printf("fetching containers for query %q ...", query)
+	checkForUpdate()
+
+	c := mustClient()
+	containers, err := c.Containers()
+	if err != nil {
+		return err
+	}
+	tabs, err := c.Tabs()
+	if err != nil {
+		return err
+	}
+	count := map[string]int{}
+	for _, t := range tabs {
+		count[t.CookieStoreID]++
+	}
+
+	for _, ct := range containers {
+		wf.NewItem(containerLabel(ct)).
+			Subtitle(pluralise(count[ct.ID], "tab", "tabs")+" · ↩ to open new tab").
+			Match(ct.Name).
+			Arg(ct.ID).
+			UID(ct.ID).
+			Valid(true).
+			Icon(iconTab).
+			Var("CMD", "container").
+			Var("ACTION", "open").
+			Var("CONTAINER", ct.ID)
+	}
+
+	if query != "" {
+		_ = wf.Filter(query)
+	}
+
+	wf.WarnEmpty("No Matching Containers", "Containers may be disabled in Firefox")
+	wf.SendFeedback()
+	return nil
+}
+
+// open a new tab in the given container
+func runContainerAction(_ []string) error {
+	useTextErrors()
+	if containerID == "" {
+		return errors.New("no container ID")
+	}
+
+	log.Printf("running action %q on container %q ...", action, containerID)
+	c := mustClient()
+	switch action {
+	case "open":
+		if _, err := c.OpenURL(OpenURLArg{CookieStoreID: containerID}); err != nil {
+			return err
+		}
+		return activateBrowser(c)
+	default:
+		return fmt.Errorf("unknown container action %q", action)
+	}
+}
+
+// list containers to reopen tab or open URL in
+func pickContainer() error {
+	c := mustClient()
+	tab, isTab, err := pickerTab(c)
+	if err != nil {
+		return err
+	}
+	if isTab && tab.Incognito {
+		return errors.New("private tabs can't be opened in a container")
+	}
+	containers, err := c.Containers()
+	if err != nil {
+		return err
+	}
+
+	sub := "Open URL in this container"
+	if isTab {
+		sub = "Reopen tab in this container"
+		if tab.CookieStoreID != defaultContainer {
+			pickerItem("No Container", "Reopen tab outside any container", defaultContainer, iconTab).
+				Var("CONTAINER", defaultContainer)
+		}
+	}
+	for _, ct := range containers {
+		if isTab && ct.ID == tab.CookieStoreID {
+			continue
+		}
+		pickerItem(containerLabel(ct), sub, ct.ID, iconTab).Var("CONTAINER", ct.ID)
+	}
+	return nil
+}
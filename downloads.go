@@ -0,0 +1,272 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	aw "github.com/deanishe/awgo"
+	"github.com/deanishe/awgo/util"
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+// how often download -wait checks whether the download has finished
+const downloadPollInterval = time.Millisecond * 500
+
+var (
+	downloadFlags    = flag.NewFlagSet("download", flag.ExitOnError)
+	downloadFilename string        // where to save download, relative to downloads directory
+	downloadSaveAs   bool          // show "Save As" dialog
+	downloadWait     bool          // wait for download to finish
+	downloadTimeout  time.Duration // how long to wait
+	// start a download or run an action on one
+	downloadCmd = &ffcli.Command{
+		Name: "download",
+		Usage: "alfred-firefox -url <url> download [-filename <name>] [-save-as] [-wait [-timeout <duration>]]\n" +
+			"  alfred-firefox -download <id> -action <name> download",
+		ShortHelp: "download URL or execute download action",
+		LongHelp: wrap(`
+			With -url, download the URL with Firefox, which sends its
+			cookies, so files behind a login can be fetched. Prints the
+			ID of the new download, or with -wait, waits for the download
+			to finish and prints the path of the file.
+
+			With -download, pause, resume, cancel or retry the specified
+			download, remove it from the downloads list (-action erase)
+			or delete the downloaded file (-action delete-file).
+		`),
+		FlagSet: downloadFlags,
+		Exec:    runDownload,
+	}
+
+	// messages shown after download actions
+	downloadMessages = map[string]string{
+		"pause":       "Download paused",
+		"resume":      "Download resumed",
+		"cancel":      "Download cancelled",
+		"retry":       "Download restarted",
+		"erase":       "Removed download from list",
+		"delete-file": "Deleted downloaded file",
+	}
+)
+
+func init() {
+	downloadFlags.StringVar(&downloadFilename, "filename", "",
+		"save as `path` relative to downloads directory")
+	downloadFlags.BoolVar(&downloadSaveAs, "save-as", false, "ask where to save file")
+	downloadFlags.BoolVar(&downloadWait, "wait", false, "wait for download to finish and print its path")
+	downloadFlags.DurationVar(&downloadTimeout, "timeout", 0, "how long -wait waits (0 = no limit)")
+}
+
+// humanBytes returns a human-readable file size, e.g. "4.2 MB".
+func humanBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
+
+// downloadStatus returns a description of a download's state, progress and
+// file, e.g. "45% · 1.2 MB of 2.7 MB · https://...".
+func downloadStatus(dl Download) string {
+	var parts []string
+	if dl.Dangerous() {
+		parts = append(parts, "⚠️ Potentially dangerous")
+	}
+	switch dl.State {
+	case downloadInProgress:
+		var progress string
+		if dl.TotalBytes > 0 {
+			progress = fmt.Sprintf("%s of %s", humanBytes(dl.BytesReceived), humanBytes(dl.TotalBytes))
+		} else {
+			progress = humanBytes(dl.BytesReceived) + " received"
+		}
+		if dl.Paused {
+			parts = append(parts, "Paused", progress)
+		} else if dl.TotalBytes > 0 {
+			parts = append(parts, fmt.Sprintf("%d%%", dl.BytesReceived*100/dl.TotalBytes), progress)
+		} else {
+			parts = append(parts, progress)
+		}
+		parts = append(parts, dl.URL)
+	case downloadInterrupted:
+		if dl.Err == "USER_CANCELED" {
+			parts = append(parts, "Cancelled")
+		} else {
+			parts = append(parts, "Failed ("+dl.Err+")")
+		}
+		parts = append(parts, dl.URL)
+	default:
+		if !dl.Exists {
+			parts = append(parts, "File deleted", dl.URL)
+			break
+		}
+		parts = append(parts, humanBytes(dl.Size))
+		if dl.EndTime > 0 {
+			parts = append(parts, relativeTime(time.Unix(0, dl.EndTime*int64(time.Millisecond))))
+		}
+		parts = append(parts, util.PrettyPath(dl.Path))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// downloadItem adds an Alfred item for a download. The default action
+// depends on the download's state: open the file if the download is
+// complete, pause or resume it if it's in progress, or otherwise resume or
+// retry it.
+func downloadItem(dl Download) *aw.Item {
+	var (
+		id   = fmt.Sprintf("%d", dl.ID)
+		name = filepath.Base(dl.Path)
+		uid  = dl.Path
+	)
+	if dl.Path == "" {
+		name, uid = dl.URL, id
+	}
+	it := wf.NewItem(name).
+		Subtitle(downloadStatus(dl)).
+		Arg(dl.Path).
+		UID(uid).
+		Icon(&aw.Icon{Value: dl.Path, Type: aw.IconTypeFileIcon}).
+		Valid(true).
+		Var("CMD", "download").
+		Var("DOWNLOAD", id)
+
+	var primary, alt string // ↩ and ⌥↩ actions
+	switch {
+	case dl.State == downloadComplete && dl.Exists:
+		it.IsFile(true).Var("CMD", "open")
+		it.NewModifier(aw.ModCmd).
+			Subtitle("Reveal in Finder").
+			Var("CMD", "reveal")
+		alt = "delete-file"
+	case dl.State == downloadInProgress:
+		primary, alt = "pause", "cancel"
+		if dl.Paused {
+			primary = "resume"
+		}
+	case dl.State == downloadInterrupted && dl.CanResume:
+		primary = "resume"
+	default:
+		primary = "retry"
+		it.Icon(iconURL)
+	}
+	if primary != "" {
+		it.Var("ACTION", primary)
+	}
+
+	subtitles := map[string]string{
+		"delete-file": "Delete File",
+		"cancel":      "Cancel Download",
+	}
+	if alt != "" {
+		it.NewModifier(aw.ModOpt).
+			Subtitle(subtitles[alt]).
+			Var("CMD", "download").
+			Var("ACTION", alt)
+	}
+	it.NewModifier(aw.ModCtrl).
+		Subtitle("Remove from List").
+		Var("CMD", "download").
+		Var("ACTION", "erase")
+	return it
+}
+
+// download a URL or run an action on a download
+func runDownload(_ []string) error {
+	useTextErrors()
+	if downloadID == 0 {
+		if URL == "" {
+			return errors.New("no URL or download ID")
+		}
+		return downloadURL(URL)
+	}
+	return runDownloadAction()
+}
+
+// download URL, optionally waiting for the download to finish
+func downloadURL(URL string) error {
+	log.Printf("downloading %q ...", URL)
+	c := mustClient()
+	dl, err := c.DownloadURL(DownloadURLArg{URL: URL, Filename: downloadFilename, SaveAs: downloadSaveAs})
+	if err != nil {
+		return err
+	}
+	if !downloadWait {
+		fmt.Println(dl.ID)
+		return nil
+	}
+
+	if dl, err = waitForDownload(c, dl, downloadTimeout); err != nil {
+		return err
+	}
+	fmt.Println(dl.Path)
+	return nil
+}
+
+// waitForDownload polls the browser until dl is no longer in progress and
+// returns it. It returns an error if the download fails, or if it hasn't
+// finished after timeout (if timeout isn't 0).
+func waitForDownload(c *rpcClient, dl Download, timeout time.Duration) (Download, error) {
+	var (
+		start = time.Now()
+		err   error
+	)
+	for dl.State == downloadInProgress {
+		if timeout > 0 && time.Since(start) > timeout {
+			return dl, fmt.Errorf("download #%d not finished after %v", dl.ID, timeout)
+		}
+		time.Sleep(downloadPollInterval)
+		if dl, err = c.Download(dl.ID); err != nil {
+			return dl, err
+		}
+	}
+	if dl.State != downloadComplete {
+		return dl, fmt.Errorf("download #%d failed: %s", dl.ID, dl.Err)
+	}
+	return dl, nil
+}
+
+// run an action on a download
+func runDownloadAction() error {
+	log.Printf("running action %q on download #%d ...", action, downloadID)
+
+	var (
+		c   = mustClient()
+		err error
+	)
+	switch action {
+	case "pause":
+		err = c.PauseDownload(downloadID)
+	case "resume":
+		err = c.ResumeDownload(downloadID)
+	case "cancel":
+		err = c.CancelDownload(downloadID)
+	case "retry":
+		_, err = c.RetryDownload(downloadID)
+	case "erase":
+		err = c.EraseDownload(downloadID)
+	case "delete-file":
+		err = c.DeleteDownloadFile(downloadID)
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(downloadMessages[action])
+	return nil
+}
@@ -0,0 +1,384 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+// Export formats.
+const (
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+	formatJSON     = "json"
+	formatCSV      = "csv"
+	formatNetscape = "netscape-bookmarks"
+)
+
+var (
+	exportFlags  = flag.NewFlagSet("export", flag.ExitOnError)
+	exportKind   string // what to export
+	exportFormat string // how to format it
+	exportOutput string // file to write to
+	// export tabs, bookmarks etc.
+	exportCmd = &ffcli.Command{
+		Name:      "export",
+		Usage:     "alfred-firefox [-query <query>] [-window <id>] export [-kind <kind>] [-format <format>] [-o <file>]",
+		ShortHelp: "export tabs, bookmarks, history or downloads",
+		LongHelp: wrap(`
+			Export tabs, bookmarks, history or downloads as Markdown,
+			HTML, JSON, CSV or a Netscape bookmarks file, which browsers
+			can import. Output is written to stdout unless -o is given.
+
+			-kind is one of tabs (default), bookmarks, history or
+			downloads. -format is one of markdown (default), html, json,
+			csv or netscape-bookmarks.
+
+			Tabs are exported from all windows, or only the window given
+			by -window. Bookmarks, history and downloads are filtered by
+			-query. History is limited to the 200 most recent matches.
+		`),
+		FlagSet: exportFlags,
+		Exec:    runExport,
+	}
+)
+
+func init() {
+	exportFlags.StringVar(&exportKind, "kind", "tabs", "what to export: tabs, bookmarks, history or downloads")
+	exportFlags.StringVar(&exportFormat, "format", formatMarkdown,
+		"output format: markdown, html, json, csv or netscape-bookmarks")
+	exportFlags.StringVar(&exportOutput, "o", "", "write to `file` instead of stdout")
+}
+
+// exportRecord is a tab, bookmark, history entry or download in an export.
+type exportRecord struct {
+	Title  string
+	URL    string
+	Folder string   // group record belongs to, e.g. bookmark folder or window
+	Fields []string // CSV columns
+}
+
+// exportList is the records to export and the original models, which are
+// exported as-is in JSON format.
+type exportList struct {
+	Kind    string
+	Header  []string // CSV header
+	Records []exportRecord
+	Models  interface{}
+}
+
+// loadExport fetches the items of the specified kind from Firefox.
+func loadExport(c *rpcClient, kind string) (exportList, error) {
+	list := exportList{Kind: kind}
+	switch kind {
+	case "tabs":
+		return loadExportTabs(c, windowID)
+
+	case "bookmarks":
+		bookmarks, err := c.Bookmarks(query)
+		if err != nil {
+			return list, err
+		}
+		meta, err := loadPlacesMeta()
+		if err != nil {
+			log.Printf("[WARNING] read bookmark tags: %v", err)
+		}
+		list.Header = []string{"title", "url", "folder", "tags", "keyword"}
+		for i, bm := range bookmarks {
+			m := meta[bm.ID]
+			bm.Tags, bm.Keyword = m.Tags, m.Keyword
+			bookmarks[i] = bm
+			list.Records = append(list.Records, exportRecord{
+				Title:  bm.Title,
+				URL:    bm.URL,
+				Folder: bm.Path,
+				Fields: []string{bm.Title, bm.URL, bm.Path, strings.Join(bm.Tags, ","), bm.Keyword},
+			})
+		}
+		list.Models = bookmarks
+
+	case "history":
+		history, err := c.History(query)
+		if err != nil {
+			return list, err
+		}
+		list.Header = []string{"title", "url"}
+		for _, h := range history {
+			list.Records = append(list.Records, exportRecord{
+				Title:  h.Title,
+				URL:    h.URL,
+				Fields: []string{h.Title, h.URL},
+			})
+		}
+		list.Models = history
+
+	case "downloads":
+		downloads, err := c.Downloads(query)
+		if err != nil {
+			return list, err
+		}
+		list.Header = []string{"path", "url", "size", "mime"}
+		for _, dl := range downloads {
+			list.Records = append(list.Records, exportRecord{
+				Title:  filepath.Base(dl.Path),
+				URL:    dl.URL,
+				Fields: []string{dl.Path, dl.URL, strconv.FormatInt(dl.Size, 10), dl.MimeType},
+			})
+		}
+		list.Models = downloads
+
+	default:
+		return list, fmt.Errorf("unknown kind %q", kind)
+	}
+	return list, nil
+}
+
+// loadExportTabs fetches the tabs in window winID, or all windows if winID
+// is 0, in window and tab order. Each window is a folder.
+func loadExportTabs(c *rpcClient, winID int) (exportList, error) {
+	list := exportList{Kind: "tabs"}
+	windows, err := c.Windows()
+	if err != nil {
+		return list, err
+	}
+	tabs := []Tab{}
+	list.Header = []string{"title", "url", "window", "pinned", "last used"}
+	for i, w := range windows {
+		if winID != 0 && w.ID != winID {
+			continue
+		}
+		folder := fmt.Sprintf("Window %d", i+1)
+		for _, t := range w.Tabs {
+			tabs = append(tabs, t)
+			list.Records = append(list.Records, exportRecord{
+				Title:  t.Title,
+				URL:    t.URL,
+				Folder: folder,
+				Fields: []string{t.Title, t.URL, strconv.Itoa(w.ID), strconv.FormatBool(t.Pinned),
+					time.Unix(0, t.LastAccessed*int64(time.Millisecond)).Format(time.RFC3339)},
+			})
+		}
+	}
+	list.Models = tabs
+	return list, nil
+}
+
+// writeExport writes list to w in the specified format.
+func writeExport(w io.Writer, list exportList, format string) error {
+	switch format {
+	case formatMarkdown:
+		return writeMarkdown(w, list)
+	case formatHTML:
+		return writeHTML(w, list)
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list.Models)
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		_ = cw.Write(list.Header)
+		for _, r := range list.Records {
+			_ = cw.Write(r.Fields)
+		}
+		cw.Flush()
+		return cw.Error()
+	case formatNetscape:
+		return writeNetscape(w, list)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// exportGroups splits records into runs with the same folder, keeping their
+// order. Records are sorted by folder first if they aren't already grouped.
+func exportGroups(records []exportRecord) [][]exportRecord {
+	var (
+		groups [][]exportRecord
+		seen   = map[string]bool{}
+	)
+	for i, r := range records {
+		if i == 0 || r.Folder != records[i-1].Folder {
+			if seen[r.Folder] {
+				sorted := append([]exportRecord{}, records...)
+				sort.SliceStable(sorted, func(i, j int) bool {
+					return lessPath(sorted[i].Folder, sorted[j].Folder)
+				})
+				return exportGroups(sorted)
+			}
+			seen[r.Folder] = true
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], r)
+	}
+	return groups
+}
+
+// lessPath compares folder paths name by name, so folders sort directly
+// before their subfolders.
+func lessPath(a, b string) bool {
+	var (
+		as = splitBookmarkPath(a)
+		bs = splitBookmarkPath(b)
+	)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	if len(as) != len(bs) {
+		return len(as) < len(bs)
+	}
+	return a < b
+}
+
+// markdown link text and URLs can't contain unescaped brackets
+var (
+	mdTitleEscaper = strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`)
+	mdURLEscaper   = strings.NewReplacer(`(`, `%28`, `)`, `%29`, ` `, `%20`)
+)
+
+// writeMarkdown writes records as a list of links with a heading for
+// each folder, if there is more than one.
+func writeMarkdown(w io.Writer, list exportList) error {
+	var buf bytes.Buffer
+	groups := exportGroups(list.Records)
+	for i, g := range groups {
+		if len(groups) > 1 && g[0].Folder != "" {
+			if i > 0 {
+				buf.WriteString("\n")
+			}
+			fmt.Fprintf(&buf, "## %s\n\n", g[0].Folder)
+		}
+		for _, r := range g {
+			title := r.Title
+			if title == "" {
+				title = r.URL
+			}
+			fmt.Fprintf(&buf, "- [%s](%s)\n", mdTitleEscaper.Replace(title), mdURLEscaper.Replace(r.URL))
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeHTML writes records as an HTML document with a list of links for
+// each folder.
+func writeHTML(w io.Writer, list exportList) error {
+	var buf bytes.Buffer
+	title := "Firefox " + strings.Title(list.Kind)
+	fmt.Fprintf(&buf, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n<h1>%s</h1>\n",
+		title, title)
+	for _, g := range exportGroups(list.Records) {
+		if g[0].Folder != "" {
+			fmt.Fprintf(&buf, "<h2>%s</h2>\n", html.EscapeString(g[0].Folder))
+		}
+		buf.WriteString("<ul>\n")
+		for _, r := range g {
+			t := r.Title
+			if t == "" {
+				t = r.URL
+			}
+			fmt.Fprintf(&buf, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(r.URL), html.EscapeString(t))
+		}
+		buf.WriteString("</ul>\n")
+	}
+	buf.WriteString("</body>\n</html>\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeNetscape writes records in the Netscape bookmarks format, which
+// browsers can import. Folder paths become nested folders.
+func writeNetscape(w io.Writer, list exportList) error {
+	var (
+		buf  bytes.Buffer
+		open []string // currently open folders
+	)
+	indent := func() string { return strings.Repeat("    ", len(open)+1) }
+	buf.WriteString("<!DOCTYPE NETSCAPE-Bookmark-file-1>\n" +
+		"<META HTTP-EQUIV=\"Content-Type\" CONTENT=\"text/html; charset=UTF-8\">\n" +
+		"<TITLE>Bookmarks</TITLE>\n<H1>Bookmarks</H1>\n<DL><p>\n")
+	for _, g := range exportGroups(list.Records) {
+		path := splitBookmarkPath(g[0].Folder)
+		// close folders not in path, then open the rest of path
+		n := 0
+		for n < len(open) && n < len(path) && open[n] == path[n] {
+			n++
+		}
+		for len(open) > n {
+			open = open[:len(open)-1]
+			buf.WriteString(indent() + "</DL><p>\n")
+		}
+		for _, name := range path[n:] {
+			fmt.Fprintf(&buf, "%s<DT><H3>%s</H3>\n%s<DL><p>\n", indent(), html.EscapeString(name), indent())
+			open = append(open, name)
+		}
+		for _, r := range g {
+			fmt.Fprintf(&buf, "%s<DT><A HREF=\"%s\">%s</A>\n", indent(), html.EscapeString(r.URL), html.EscapeString(r.Title))
+		}
+	}
+	for len(open) > 0 {
+		open = open[:len(open)-1]
+		buf.WriteString(indent() + "</DL><p>\n")
+	}
+	buf.WriteString("</DL><p>\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// export tabs, bookmarks, history or downloads
+func runExport(_ []string) error {
+	useTextErrors()
+	log.Printf("exporting %s as %s ...", exportKind, exportFormat)
+	list, err := loadExport(mustClient(), exportKind)
+	if err != nil {
+		return err
+	}
+
+	if exportOutput == "" {
+		return writeExport(os.Stdout, list, exportFormat)
+	}
+	var buf bytes.Buffer
+	if err := writeExport(&buf, list, exportFormat); err != nil {
+		return err
+	}
+	log.Printf("writing %d %s to %q ...", len(list.Records), exportKind, exportOutput)
+	return ioutil.WriteFile(exportOutput, buf.Bytes(), 0600)
+}
+
+// copy tabs in window winID (0 = all windows) to the clipboard as Markdown
+func copyTabsMarkdown(c *rpcClient, winID int) error {
+	list, err := loadExportTabs(c, winID)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := writeMarkdown(&buf, list); err != nil {
+		return err
+	}
+	cmd := exec.Command("/usr/bin/pbcopy")
+	cmd.Stdin = &buf
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	fmt.Printf("Copied %s\n", pluralise(len(list.Records), "tab", "tabs"))
+	return nil
+}
@@ -9,6 +9,45 @@ const appName = 'net.deanishe.alfred.firefox';
 const iconConnected = 'icons/bowler.svg';
 const iconDisconnected = 'icons/bowler-red.svg';
 
+/**
+ * Number of bytes of a message per chunk. Larger messages are split into
+ * chunks, as the native application rejects frames over 64 MB and
+ * Firefox won't pass it messages over 1 MB.
+ * @var {number} chunkSize
+ */
+const chunkSize = 512 * 1024;
+
+/**
+ * Split message into base64-encoded chunks of at most chunkSize bytes.
+ * @param {Uint8Array} bytes - UTF-8-encoded JSON message.
+ * @return {string[]} - base64-encoded chunks.
+ */
+const toChunks = bytes => {
+  let chunks = [];
+  for (let i = 0; i < bytes.length; i += chunkSize) {
+    let s = '';
+    bytes.subarray(i, i + chunkSize).forEach(b => (s += String.fromCharCode(b)));
+    chunks.push(btoa(s));
+  }
+  return chunks;
+};
+
+/**
+ * Reassemble base64-encoded chunks into a string.
+ * @param {string[]} chunks - base64-encoded chunks.
+ * @return {string} - Reassembled message.
+ */
+const fromChunks = chunks => {
+  let parts = chunks.map(c => Uint8Array.from(atob(c), ch => ch.charCodeAt(0)));
+  let bytes = new Uint8Array(parts.reduce((n, p) => n + p.length, 0));
+  let offset = 0;
+  parts.forEach(p => {
+    bytes.set(p, offset);
+    offset += p.length;
+  });
+  return new TextDecoder().decode(bytes);
+};
+
 /**
  * Tab object.
  * @param {tabs.Tab} tab - Native tab object to create Tab from.
@@ -19,13 +58,20 @@ const Tab = tab => {
 
   tab = tab || {};
 
-  obj.id         = tab.id          || 0;
-  obj.windowId   = tab.windowId    || 0;
-  obj.index      = tab.index       || 0;
-  obj.title      = tab.title       || '';
-  obj.url        = new URL(tab.url || '');
-  // obj.favicon = tab.favIconUrl  || '';
-  obj.active     = tab.active      || false;
+  obj.id            = tab.id            || 0;
+  obj.windowId      = tab.windowId      || 0;
+  obj.index         = tab.index         || 0;
+  obj.title         = tab.title         || '';
+  obj.url           = new URL(tab.url   || '');
+  obj.active        = tab.active        || false;
+  obj.pinned        = tab.pinned        || false;
+  obj.audible       = tab.audible       || false;
+  obj.muted         = tab.mutedInfo?.muted ?? false;
+  obj.discarded     = tab.discarded     || false;
+  obj.incognito     = tab.incognito     || false;
+  obj.lastAccessed  = tab.lastAccessed  || 0;
+  obj.favIconUrl    = tab.favIconUrl    || '';
+  obj.cookieStoreId = tab.cookieStoreId || '';
 
   obj.toString = function() {
     return `#${this.id} (${this.windowId}x${this.index}) "${this.title}" - ${this.url}`;
@@ -34,12 +80,79 @@ const Tab = tab => {
   return obj;
 };
 
+/**
+ * Window object. Not called Window to avoid shadowing the DOM interface.
+ * @param {windows.Window} win - Native window object to create BrowserWindow from.
+ * @return {Object} - API Window object.
+ */
+const BrowserWindow = win => {
+  let obj = {};
+  win = win || {};
+
+  obj.id        = win.id        || 0;
+  obj.title     = win.title     || '';
+  obj.focused   = win.focused   || false;
+  obj.incognito = win.incognito || false;
+  obj.state     = win.state     || 'normal';
+  obj.tabs      = (win.tabs || []).map(t => Tab(t));
+
+  obj.toString = function() {
+    return `#${this.id} "${this.title}" (${this.tabs.length} tabs)`;
+  };
+
+  return obj;
+};
+
+/**
+ * Session object, i.e. a recently-closed tab or window.
+ * @param {sessions.Session} s - Native object to create Session from.
+ * @return {Object} - API Session object.
+ */
+const Session = s => {
+  let obj = {};
+  s = s || {};
+
+  obj.sessionId    = s.tab?.sessionId ?? s.window?.sessionId ?? '';
+  obj.lastModified = s.lastModified || 0;
+  obj.tab          = s.tab ? Tab(s.tab) : null;
+  obj.window       = s.window ? BrowserWindow(s.window) : null;
+
+  obj.toString = function() {
+    return `${this.sessionId} ${this.tab ? this.tab : this.window}`;
+  };
+
+  return obj;
+};
+
+/**
+ * Container object.
+ * @param {contextualIdentities.ContextualIdentity} ci - Native object to create Container from.
+ * @return {Object} - API Container object.
+ */
+const Container = ci => {
+  let obj = {};
+  ci = ci || {};
+
+  obj.cookieStoreId = ci.cookieStoreId || '';
+  obj.name          = ci.name          || '';
+  obj.color         = ci.color         || '';
+  obj.colorCode     = ci.colorCode     || '';
+  obj.icon          = ci.icon          || '';
+
+  obj.toString = function() {
+    return `${this.cookieStoreId} "${this.name}" (${this.color})`;
+  };
+
+  return obj;
+};
+
 /**
  * Bookmark object.
  * @param {bookmarks.BookmarkTreeNode} bm - Native object to create Bookmark from.
+ * @param {string} path - Path of folder containing bookmark.
  * @return {Object} - API Bookmark object.
  */
-const Bookmark = bm => {
+const Bookmark = (bm, path) => {
   let obj = {};
   bm = bm || {};
 
@@ -49,6 +162,7 @@ const Bookmark = bm => {
   obj.parentId = bm.parentId || 0;
   obj.type     = bm.type     || '';
   obj.url      = bm.url      || '';
+  obj.path     = path        || '';
 
   obj.toString = function() {
     return `#${this.id} "${this.title}" - ${this.url}`;
@@ -57,6 +171,24 @@ const Bookmark = bm => {
   return obj;
 };
 
+/**
+ * Paths of bookmark folders.
+ * @param {bookmarks.BookmarkTreeNode} root - Root of bookmark tree.
+ * @return {Object} - Folder paths, e.g. "Bookmarks Toolbar/Go", keyed by
+ * folder ID. The root folder's path is empty.
+ */
+const folderPaths = root => {
+  let paths = {};
+  let addPaths = (node, path) => {
+    paths[node.id] = path;
+    (node.children || [])
+      .filter(n => n.type === 'folder')
+      .map(n => addPaths(n, path ? `${path}/${n.title}` : n.title));
+  };
+  addPaths(root, '');
+  return paths;
+};
+
 /**
  * HistoryEntry object.
  * @param {history.HistoryItem} hi - Native object to create HistoryEntry from.
@@ -66,9 +198,12 @@ const HistoryEntry = hi => {
   let obj = {};
   hi = hi || {};
 
-  obj.id    = hi.id    || 0;
-  obj.url   = hi.url   || '';
-  obj.title = hi.title || hi.url;
+  obj.id            = hi.id            || 0;
+  obj.url           = hi.url           || '';
+  obj.title         = hi.title         || hi.url;
+  obj.visitCount    = hi.visitCount    || 0;
+  obj.typedCount    = hi.typedCount    || 0;
+  obj.lastVisitTime = hi.lastVisitTime || 0;
 
   obj.toString = function() {
     return `#${this.id} "${this.title}" - ${this.url}`;
@@ -77,6 +212,30 @@ const HistoryEntry = hi => {
   return obj;
 };
 
+/**
+ * Visit object.
+ * @param {history.VisitItem} vi - Native object to create Visit from.
+ * @param {string} url - URL that was visited.
+ * @return {Object} - API Visit object.
+ */
+const Visit = (vi, url) => {
+  let obj = {};
+  vi = vi || {};
+
+  obj.visitId          = vi.visitId          || '';
+  obj.id               = vi.id               || '';
+  obj.url              = url                 || '';
+  obj.visitTime        = vi.visitTime        || 0;
+  obj.referringVisitId = vi.referringVisitId || '';
+  obj.transition       = vi.transition       || '';
+
+  obj.toString = function() {
+    return `${this.visitId} ${this.transition} - ${this.url}`;
+  };
+
+  return obj;
+};
+
 /**
  * Download object.
  * @param {downloads.DownloadItem} di - Native object to create Download from.
@@ -86,13 +245,21 @@ const Download = di => {
   let obj = {};
   di = di || {};
 
-  obj.id     = di.id       || 0;
-  obj.path   = di.filename || '';
-  obj.size   = di.fileSize || 0;
-  obj.url    = di.url      || '';
-  obj.mime   = di.mime     || '';
-  obj.exists = di.exists   || false;
-  obj.error  = di.error    || '';
+  obj.id            = di.id            || 0;
+  obj.path          = di.filename      || '';
+  obj.size          = di.fileSize      || 0;
+  obj.url           = di.url           || '';
+  obj.mime          = di.mime          || '';
+  obj.exists        = di.exists        || false;
+  obj.error         = di.error         || '';
+  obj.state         = di.state         || '';
+  obj.paused        = di.paused        || false;
+  obj.canResume     = di.canResume     || false;
+  obj.bytesReceived = di.bytesReceived || 0;
+  obj.totalBytes    = di.totalBytes    || -1;
+  obj.startTime     = Date.parse(di.startTime) || 0;
+  obj.endTime       = Date.parse(di.endTime)   || 0;
+  obj.danger        = di.danger        || 'safe';
 
   obj.toString = function() {
     return `#${this.id} "${this.path}" - ${this.url}`;
@@ -112,6 +279,31 @@ const Background = function() {
     self.nativePort = null,
     self.connected = false;
 
+  /**
+   * IDs of commands that are still being processed.
+   * @var {Set} pending
+   */
+  self.pending = new Set();
+
+  /**
+   * IDs of pending commands the native application has given up on.
+   * Responses to these commands are discarded.
+   * @var {Set} cancelled
+   */
+  self.cancelled = new Set();
+
+  /**
+   * Partially-received chunked messages, keyed by message ID.
+   * @var {Object} chunks
+   */
+  self.chunks = {};
+
+  /**
+   * Counter for IDs of chunked messages that don't have their own ID.
+   * @var {number} lastChunkId
+   */
+  self.lastChunkId = 0;
+
   self.onConnected = port => {
     self.port = port;
     port.onMessage.addListener(self.receive);
@@ -182,6 +374,72 @@ const Background = function() {
     browser.browserAction.setIcon({ path: iconConnected });
   };
 
+  /**
+   * Handlers for commands from native application, keyed by command name.
+   * Each handler is passed the command's params and returns a Promise.
+   * The names are also reported to the native application by "hello".
+   * @var {Object} commands
+   */
+  self.commands = {
+    'hello': () => self.hello(),
+    'ping': () => self.ping(),
+    'all-windows': () => self.allWindows(),
+    'focus-window': params => self.focusWindow(params),
+    'minimize-window': params => self.minimizeWindow(params),
+    'close-window': params => self.closeWindow(params),
+    'new-window': params => self.newWindow(params),
+    // 'current-window': () => self.currentWindow(),
+    'all-tabs': () => self.allTabs(),
+    // DEPRECATED - replaced by self.tab(); unused by newer
+    // versions 0.2.0+ of workflow
+    // Remove from future versions
+    'current-tab': () => self.tab(0),
+    'tab': params => self.tab(params),
+    'all-bookmarks': () => self.allBookmarks(),
+    'search-bookmarks': params => self.searchBookmarks(params),
+    'bookmark-tree': () => self.bookmarkTree(),
+    'create-bookmark': params => self.createBookmark(params),
+    'update-bookmark': params => self.updateBookmark(params),
+    'move-bookmark': params => self.moveBookmark(params),
+    'delete-bookmark': params => self.deleteBookmark(params),
+    'search-history': params => self.searchHistory(params),
+    'query-history': params => self.queryHistory(params),
+    'delete-history-urls': params => self.deleteHistoryURLs(params),
+    'get-visits': params => self.getVisits(params),
+    'delete-history-range': params => self.deleteHistoryRange(params),
+    'delete-history-visits': params => self.deleteHistoryVisits(params),
+    'search-downloads': params => self.searchDownloads(params),
+    'get-download': params => self.getDownload(params),
+    'download-url': params => self.downloadURL(params),
+    'pause-download': params => self.pauseDownload(params),
+    'resume-download': params => self.resumeDownload(params),
+    'cancel-download': params => self.cancelDownload(params),
+    'retry-download': params => self.retryDownload(params),
+    'erase-download': params => self.eraseDownload(params),
+    'delete-download-file': params => self.deleteDownloadFile(params),
+    'activate-tab': params => self.activateTab(params),
+    'close-tabs-left': params => self.closeTabsLeft(params),
+    'close-tabs-right': params => self.closeTabsRight(params),
+    'close-tabs-other': params => self.closeTabsOther(params),
+    'close-tab': params => self.closeTab(params),
+    'close-tabs': params => self.closeTabs(params),
+    'duplicate-tab': params => self.duplicateTab(params),
+    'reload-tab': params => self.reloadTab(params),
+    'pin-tab': params => self.pinTab(params),
+    'mute-tab': params => self.muteTab(params),
+    'discard-tab': params => self.discardTab(params),
+    'move-tab-to-window': params => self.moveTabToWindow(params),
+    'move-tabs': params => self.moveTabs(params),
+    'all-containers': () => self.allContainers(),
+    'recently-closed': params => self.recentlyClosed(params),
+    'restore-session': params => self.restoreSession(params),
+    'reopen-tab-in-container': params => self.reopenTabInContainer(params),
+    'execute-js': params => self.executeJS(params),
+    'run-bookmarklet': params => self.runBookmarklet(params),
+    'open-incognito': params => self.openIncognito(params),
+    'open-url': params => self.openURL(params),
+  };
+
   /**
    * Handle commands from native application.
    * @param {Object} msg - Data from native application.
@@ -190,72 +448,31 @@ const Background = function() {
    */
   self.receiveNative = msg => {
     console.log(`received:`, msg);
-    let p = null;
+    if ('chunk' in msg) {
+      self.receiveChunk(msg);
+      return;
+    }
     if ('command' in msg) {
-      switch (msg.command) {
-        case 'ping':
-          p = self.ping();
-          break;
-        // case 'all-windows':
-        //   p = self.allWindows();
-        //   break;
-        // case 'current-window':
-        //   p = self.currentWindow();
-        //   break;
-        case 'all-tabs':
-          p = self.allTabs();
-          break;
-        // DEPRECATED - replaced by self.tab(); unused by newer
-        // versions 0.2.0+ of workflow
-        // Remove from future versions
-        case 'current-tab':
-          p = self.tab(0);
-          break;
-        case 'tab':
-          p = self.tab(msg.params);
-          break;
-        case 'all-bookmarks':
-          p = self.allBookmarks();
-          break;
-        case 'search-bookmarks':
-          p = self.searchBookmarks(msg.params);
-          break;
-        case 'search-history':
-          p = self.searchHistory(msg.params);
-          break;
-        case 'search-downloads':
-          p = self.searchDownloads(msg.params);
-          break;
-        case 'activate-tab':
-          p = self.activateTab(msg.params);
-          break;
-        case 'close-tabs-left':
-          p = self.closeTabsLeft(msg.params);
-          break;
-        case 'close-tabs-right':
-          p = self.closeTabsRight(msg.params);
-          break;
-        case 'close-tabs-other':
-          p = self.closeTabsOther(msg.params);
-          break;
-        case 'execute-js':
-          p = self.executeJS(msg.params);
-          break;
-        case 'run-bookmarklet':
-          p = self.runBookmarklet(msg.params);
-          break;
-        case 'open-incognito':
-          p = self.openIncognito(msg.params);
-          break;
-        default:
-          console.error(`unknown command: ${msg.command}`);
-          self.sendError(msg.id, 'unknown command');
-          return;
+      // native application is no longer waiting for command
+      // with ID msg.params. No response is sent.
+      if (msg.command === 'cancel') {
+        self.cancel(msg.params);
+        return;
       }
-      p.then(payload => {
-        self.sendNative({ id: msg.id, payload: payload });
+      let handler = self.commands[msg.command];
+      if (!handler) {
+        console.error(`unknown command: ${msg.command}`);
+        self.sendError(msg.id, 'unknown command');
+        return;
+      }
+      self.pending.add(msg.id);
+      // run handler inside the promise chain, so errors it throws
+      // synchronously are also returned to the native application
+      Promise.resolve().then(() => handler(msg.params)).then(payload => {
+        if (self.done(msg.id)) self.sendNative({ id: msg.id, payload: payload });
       }).catch(err => {
-        self.sendError(msg.id, err.message);
+        // some handlers throw strings, not Errors
+        if (self.done(msg.id)) self.sendError(msg.id, err.message || String(err));
       });
     } else {
       self.sendError(msg.id, 'no command given');
@@ -263,23 +480,97 @@ const Background = function() {
   };
 
   /**
-   * Send response to native application.
+   * Handle "cancel" command.
+   * @param {string} id - ID of command whose response should be discarded.
+   */
+  self.cancel = id => {
+    if (self.pending.has(id)) {
+      console.debug(`cancelled command ${id}`);
+      self.cancelled.add(id);
+    }
+  };
+
+  /**
+   * Mark command as finished.
+   * @param {string} id - Command ID.
+   * @return {bool} - true if response should be sent, false if command
+   * was cancelled.
+   */
+  self.done = id => {
+    self.pending.delete(id);
+    if (self.cancelled.delete(id)) {
+      console.debug(`discarding response to cancelled command ${id}`);
+      return false;
+    }
+    return true;
+  };
+
+  /**
+   * Send response to native application. Messages larger than chunkSize
+   * are split into chunks, which the native application reassembles.
    * @param {Object} msg - Data to send to native application.
    * @param {string} msg.id - Command/response ID.
    * @param {string|bool|Object} msg.payload - Actual response data.
    * @param {string} msg.error - Error message if command failed.
    */
   self.sendNative = msg => {
-    if (self.nativePort) {
-      self.nativePort.postMessage(msg)
-        .then(resp => {
-          console.log(`sent:`, msg);
-          console.log(`response:`, resp);
-        })
-        .catch(err => {
-          console.error(`send error: ${err.message}`);
-      });
+    if (!self.nativePort) return;
+    try {
+      // Firefox's limit is on the UTF-8-encoded size, not the number
+      // of UTF-16 code units in the string
+      let bytes = new TextEncoder().encode(JSON.stringify(msg));
+      if (bytes.length <= chunkSize) {
+        self.nativePort.postMessage(msg);
+      } else {
+        // events have no ID, but chunks need one to be reassembled
+        let id = msg.id || `chunked-${++self.lastChunkId}`;
+        let chunks = toChunks(bytes);
+        chunks.forEach((data, i) => {
+          self.nativePort.postMessage({
+            id: id,
+            chunk: { index: i, count: chunks.length, data: data },
+          });
+        });
+        console.debug(`sent message ${id} in ${chunks.length} chunk(s)`);
+      }
+      console.log(`sent:`, msg);
+    } catch (err) {
+      console.error(`send error: ${err.message}`);
+    }
+  };
+
+  /**
+   * Add chunk of a message from native application. When all chunks
+   * have been received, the reassembled message is handled.
+   * @param {Object} msg - Chunk message.
+   * @param {string} msg.id - ID of chunked message.
+   * @param {Object} msg.chunk - Index, count and base64-encoded data of chunk.
+   */
+  self.receiveChunk = msg => {
+    let { index, count, data } = msg.chunk;
+    let parts = self.chunks[msg.id];
+    if (!parts) parts = self.chunks[msg.id] = new Array(count);
+
+    if (parts.length !== count || index < 0 || index >= count || parts[index] !== undefined) {
+      delete self.chunks[msg.id];
+      console.error(`corrupt chunk ${index}/${count} of message ${msg.id}`);
+      self.sendError(msg.id, `corrupt chunk ${index}/${count}`);
+      return;
+    }
+
+    parts[index] = data;
+    if (parts.includes(undefined)) return;
+
+    delete self.chunks[msg.id];
+    let full;
+    try {
+      full = JSON.parse(fromChunks(parts));
+    } catch (err) {
+      console.error(`corrupt chunked message ${msg.id}: ${err.message}`);
+      self.sendError(msg.id, `corrupt chunked message: ${err.message}`);
+      return;
     }
+    self.receiveNative(full);
   };
 
   /**
@@ -291,6 +582,74 @@ const Background = function() {
     self.sendNative({ id: id, error: msg });
   };
 
+  /**
+   * Push an event to native application. Events have no ID, as they
+   * aren't a response to a command.
+   * @param {string} name - Type of event, e.g. "tab-created".
+   * @param {Object} payload - Event data.
+   */
+  self.sendEvent = (name, payload) => {
+    self.sendNative({ event: name, payload: payload });
+  };
+
+  /**
+   * Register listeners for browser events that are pushed to the
+   * native application.
+   */
+  self.addEventListeners = () => {
+    browser.tabs.onCreated.addListener(tab => {
+      self.sendEvent('tab-created', Tab(tab));
+    });
+    browser.tabs.onRemoved.addListener((tabId, info) => {
+      self.sendEvent('tab-closed', { id: tabId, windowId: info.windowId });
+    });
+    browser.tabs.onActivated.addListener(info => {
+      self.sendEvent('tab-activated', { id: info.tabId, windowId: info.windowId });
+    });
+    browser.tabs.onUpdated.addListener(
+      (tabId, changes, tab) => {
+        // only report finished page loads and changes to title or
+        // audio/pinned state
+        if (changes.status && changes.status !== 'complete') return;
+        self.sendEvent('tab-updated', Tab(tab));
+      },
+      { properties: ['status', 'title', 'audible', 'mutedInfo', 'pinned'] }
+    );
+
+    browser.downloads.onChanged.addListener(delta => {
+      if (!delta.state || delta.state.current !== 'complete') return;
+      browser.downloads.search({ id: delta.id }).then(items => {
+        if (items.length) self.sendEvent('download-finished', Download(items[0]));
+      });
+    });
+
+    browser.bookmarks.onCreated.addListener((id, node) => {
+      self.sendEvent('bookmark-created', Bookmark(node));
+    });
+    browser.bookmarks.onRemoved.addListener((id, info) => {
+      self.sendEvent('bookmark-removed', { id: id, parentId: info.parentId });
+    });
+    browser.bookmarks.onChanged.addListener((id, info) => {
+      self.sendEvent('bookmark-changed', { id: id, title: info.title, url: info.url || '' });
+    });
+    browser.bookmarks.onMoved.addListener((id, info) => {
+      self.sendEvent('bookmark-moved', { id: id, parentId: info.parentId, index: info.index });
+    });
+  };
+
+  /**
+   * Handle "hello" command. Sent by native application on startup
+   * to find out what the extension supports.
+   * @return {Promise} - Resolves to object with extension version and
+   * names of supported commands.
+   */
+  self.hello = () => {
+    return Promise.resolve({
+      version: browser.runtime.getManifest().version,
+      commands: Object.keys(self.commands).concat(['cancel']),
+    });
+  };
+
   /**
    * Handle "ping" command.
    * @return {Promise} - Resolves to string "pong".
@@ -301,6 +660,58 @@ const Background = function() {
     });
   };
 
+  /**
+   * Handle "all-windows" command.
+   * @return {Promise} - Resolves to array of Window objects for all browser
+   * windows, focused window first.
+   */
+  self.allWindows = () => {
+    return browser.windows
+      .getAll({ populate: true, windowTypes: ['normal'] })
+      .then(wins => wins
+        .sort((a, b) => (b.focused ? 1 : 0) - (a.focused ? 1 : 0))
+        .map(w => BrowserWindow(w))
+      );
+  };
+
+  /**
+   * Handle "focus-window" command.
+   * @param {number} id - ID of window to bring to the front.
+   */
+  self.focusWindow = id => {
+    return browser.windows.update(id, { focused: true }).then(() => null);
+  };
+
+  /**
+   * Handle "minimize-window" command.
+   * @param {number} id - ID of window to minimise.
+   */
+  self.minimizeWindow = id => {
+    return browser.windows.update(id, { state: 'minimized' }).then(() => null);
+  };
+
+  /**
+   * Handle "close-window" command.
+   * @param {number} id - ID of window to close.
+   */
+  self.closeWindow = id => {
+    console.debug(`closing window #${id} ...`);
+    return browser.windows.remove(id);
+  };
+
+  /**
+   * Handle "new-window" command.
+   * @param {Object} params - Window options.
+   * @param {string} params.url - URL to open. New tab page if empty.
+   * @param {boolean} params.incognito - Whether to open a private window.
+   * @return {Promise} - Resolves to Window object for new window.
+   */
+  self.newWindow = params => {
+    let opts = { incognito: !!params.incognito };
+    if (params.url) opts.url = params.url;
+    return browser.windows.create(opts).then(w => BrowserWindow(w));
+  };
+
   /**
    * Handle "all-tabs" command.
    * @return {Promise} - Resolves to array of Tab objects for all tabs sorted
@@ -372,25 +783,102 @@ const Background = function() {
    */
   self.allBookmarks = () => {
     let bookmarks = [];
+    let paths = {};
     let addBookmarks = node => {
-      if (node.url) bookmarks.push(Bookmark(node));
+      if (node.url) bookmarks.push(Bookmark(node, paths[node.parentId]));
       if (node.children) node.children.map(n => addBookmarks(n));
     };
 
     return browser.bookmarks.getTree().then(root => {
+      paths = folderPaths(root[0]);
       addBookmarks(root[0]);
       return bookmarks;
     });
   };
 
+  /**
+   * Handle "bookmark-tree" command.
+   * @return {Promise} - Resolves to array of Bookmark objects for all
+   * bookmarks and folders (except the root folder and separators).
+   * Folders precede their contents.
+   */
+  self.bookmarkTree = () => {
+    let nodes = [];
+    let addNodes = node => {
+      if (node.type !== 'separator') nodes.push(Bookmark(node));
+      if (node.children) node.children.map(n => addNodes(n));
+    };
+
+    return browser.bookmarks.getTree().then(root => {
+      (root[0].children || []).map(n => addNodes(n));
+      return nodes;
+    });
+  };
+
+  /**
+   * Handle "create-bookmark" command.
+   * @param {Object} params - New bookmark.
+   * @param {string} params.parentId - ID of folder to add bookmark to.
+   * If empty, the bookmark is added to "Other Bookmarks".
+   * @param {string} params.title - Bookmark title.
+   * @param {string} params.url - Bookmark URL.
+   * @return {Promise} - Resolves to the new Bookmark.
+   */
+  self.createBookmark = params => {
+    let opts = { title: params.title, url: params.url };
+    if (params.parentId) opts.parentId = params.parentId;
+    return browser.bookmarks.create(opts).then(bm => Bookmark(bm));
+  };
+
+  /**
+   * Handle "update-bookmark" command.
+   * @param {Object} params - Bookmark ID and changes.
+   * @param {string} params.id - ID of bookmark to change.
+   * @param {string} params.title - New title. Unchanged if empty.
+   * @param {string} params.url - New URL. Unchanged if empty.
+   * @return {Promise} - Resolves to the updated Bookmark.
+   */
+  self.updateBookmark = params => {
+    let changes = {};
+    if (params.title) changes.title = params.title;
+    if (params.url) changes.url = params.url;
+    return browser.bookmarks.update(params.id, changes).then(bm => Bookmark(bm));
+  };
+
+  /**
+   * Handle "move-bookmark" command.
+   * @param {Object} params - Bookmark ID and destination.
+   * @param {string} params.id - ID of bookmark or folder to move.
+   * @param {string} params.parentId - ID of destination folder.
+   * @param {number} params.index - Position in folder. -1 is the end.
+   * @return {Promise} - Resolves to the moved Bookmark.
+   */
+  self.moveBookmark = params => {
+    let dest = { parentId: params.parentId };
+    if (params.index >= 0) dest.index = params.index;
+    return browser.bookmarks.move(params.id, dest).then(bm => Bookmark(bm));
+  };
+
+  /**
+   * Handle "delete-bookmark" command.
+   * @param {string} id - ID of bookmark or empty folder to delete.
+   */
+  self.deleteBookmark = id => {
+    return browser.bookmarks.remove(id).then(() => null);
+  };
+
   /**
    * Handle "search-bookmarks" command.
    * @param {string} query - Search query.
    * @return {Promies} - Resolves to array of Bookmark objects matching query.
    */
   self.searchBookmarks = query => {
-    return browser.bookmarks.search(query).then(nodes => {
-      let bookmarks = nodes.filter(n => n.url).map(n => Bookmark(n));
+    return Promise.all([
+      browser.bookmarks.search(query),
+      browser.bookmarks.getTree(),
+    ]).then(([nodes, root]) => {
+      let paths = folderPaths(root[0]);
+      let bookmarks = nodes.filter(n => n.url).map(n => Bookmark(n, paths[n.parentId]));
       console.debug(`${bookmarks.length} bookmark(s) for "${query}"`);
       return bookmarks;
     });
@@ -401,31 +889,181 @@ const Background = function() {
    * @param {string} query - Search query.
    * @return {Promies} - Resolves to array of History objects matching query.
    */
-  self.searchHistory = query => {
-    return browser.history.search({ text: query, startTime: 0 }).then(items => {
+  self.searchHistory = query => self.queryHistory({ text: query });
+
+  /**
+   * Handle "query-history" command.
+   * @param {Object} params - Search parameters.
+   * @param {string} params.text - Search query. Empty matches all pages.
+   * @param {number} params.startTime - Only pages visited after this time
+   * (ms since epoch). 0 for no limit.
+   * @param {number} params.endTime - Only pages visited before this time
+   * (ms since epoch). 0 for now.
+   * @param {number} params.maxResults - Maximum number of results. 0 for
+   * the default (200).
+   * @return {Promise} - Resolves to array of History objects matching query,
+   * most recently visited first.
+   */
+  self.queryHistory = params => {
+    let opts = {
+      text: params.text || '',
+      startTime: params.startTime || 0,
+      maxResults: params.maxResults || 200,
+    };
+    if (params.endTime) opts.endTime = params.endTime;
+    return browser.history.search(opts).then(items => {
       let history = items.filter(it => it.url).map(it => HistoryEntry(it));
-      console.debug(`${history.length} history item(s) for "${query}"`);
+      history.sort((a, b) => b.lastVisitTime - a.lastVisitTime);
+      console.debug(`${history.length} history item(s) for "${opts.text}"`);
       return history;
     });
   };
 
+  /**
+   * Handle "delete-history-urls" command.
+   * @param {string[]} urls - URLs to remove all visits to from history.
+   */
+  self.deleteHistoryURLs = urls => {
+    console.debug(`deleting ${urls.length} URL(s) from history ...`);
+    return Promise.all(urls.map(url => browser.history.deleteUrl({ url: url }))).then(() => null);
+  };
+
+  /**
+   * Handle "get-visits" command.
+   * @param {string[]} urls - URLs to get visits to.
+   * @return {Promise} - Resolves to array of Visit objects for all URLs.
+   */
+  self.getVisits = urls => {
+    return Promise.all(
+      urls.map(url => browser.history.getVisits({ url: url }).then(visits => visits.map(vi => Visit(vi, url))))
+    ).then(results => {
+      let visits = [].concat(...results);
+      console.debug(`${visits.length} visit(s) to ${urls.length} URL(s)`);
+      return visits;
+    });
+  };
+
+  /**
+   * Handle "delete-history-range" command.
+   * @param {Object} params - Time range to delete.
+   * @param {number} params.startTime - Delete visits after this time
+   * (ms since epoch).
+   * @param {number} params.endTime - Delete visits before this time
+   * (ms since epoch). 0 for now.
+   */
+  self.deleteHistoryRange = params => {
+    let range = {
+      startTime: params.startTime || 0,
+      endTime: params.endTime || Date.now(),
+    };
+    console.debug(`deleting history from ${range.startTime} to ${range.endTime} ...`);
+    return browser.history.deleteRange(range).then(() => null);
+  };
+
+  /**
+   * Handle "delete-history-visits" command. The history API can't delete
+   * a single visit, so the millisecond of each visit is deleted instead.
+   * @param {number[]} times - Times of visits to delete (ms since epoch).
+   */
+  self.deleteHistoryVisits = times => {
+    console.debug(`deleting ${times.length} visit(s) from history ...`);
+    return Promise.all(times.map(t => browser.history.deleteRange({ startTime: t, endTime: t + 1 }))).then(
+      () => null
+    );
+  };
+
   /**
    * Handle "search-downloads" command.
-   * @param {string} query - Search query.
-   * @return {Promise} - Resolves to array of Download objects matching query.
+   * @param {string} query - Search query. Empty matches all downloads.
+   * @return {Promise} - Resolves to array of Download objects matching query,
+   * newest first.
    */
   self.searchDownloads = query => {
+    let opts = { orderBy: ['-startTime'] };
+    if (query) opts.query = [query];
+    return browser.downloads.search(opts).then(items => {
+      console.debug(`${items.length} download(s) for "${query}"`);
+      return items.map(it => Download(it));
+    });
+  };
+
+  /**
+   * Handle "get-download" command.
+   * @param {number} id - ID of download.
+   * @return {Promise} - Resolves to Download with given ID.
+   */
+  self.getDownload = id => {
+    return browser.downloads.search({ id: id }).then(items => {
+      if (!items.length) throw new Error(`no download with ID ${id}`);
+      return Download(items[0]);
+    });
+  };
+
+  /**
+   * Handle "download-url" command. The browser's cookies are sent with the
+   * request, so the download uses the user's logged-in sessions.
+   * @param {Object} params - What to download and where to save it.
+   * @param {string} params.url - URL to download.
+   * @param {string} params.filename - Path of file relative to downloads
+   * directory. If empty, the browser chooses a name.
+   * @param {boolean} params.saveAs - Whether to show a "Save As" dialog.
+   * @return {Promise} - Resolves to the new Download.
+   */
+  self.downloadURL = params => {
+    console.debug(`download-url`, params);
+    let opts = { url: params.url, saveAs: !!params.saveAs };
+    if (params.filename) opts.filename = params.filename;
+    return browser.downloads.download(opts).then(id => self.getDownload(id));
+  };
+
+  /**
+   * Handle "pause-download" command.
+   * @param {number} id - ID of download to pause.
+   */
+  self.pauseDownload = id => browser.downloads.pause(id).then(() => null);
+
+  /**
+   * Handle "resume-download" command.
+   * @param {number} id - ID of paused or interrupted download to resume.
+   */
+  self.resumeDownload = id => browser.downloads.resume(id).then(() => null);
+
+  /**
+   * Handle "cancel-download" command.
+   * @param {number} id - ID of download to cancel.
+   */
+  self.cancelDownload = id => browser.downloads.cancel(id).then(() => null);
+
+  /**
+   * Handle "retry-download" command. Downloads the URL of a download again.
+   * @param {number} id - ID of download to retry.
+   * @return {Promise} - Resolves to the new Download.
+   */
+  self.retryDownload = id => {
     return browser.downloads
-      .search({
-        query: [query],
-        exists: true,
-      })
+      .search({ id: id })
       .then(items => {
-        console.debug(`${items.length} download(s) for "${query}"`);
-        return items.map(it => Download(it));
-      });
+        if (!items.length) throw new Error(`no download with ID ${id}`);
+        return browser.downloads.download({ url: items[0].url });
+      })
+      .then(newId => browser.downloads.search({ id: newId }))
+      .then(items => Download(items[0]));
   };
 
+  /**
+   * Handle "erase-download" command. Removes download from the list, but
+   * doesn't delete the file.
+   * @param {number} id - ID of download to remove.
+   */
+  self.eraseDownload = id => browser.downloads.erase({ id: id }).then(() => null);
+
+  /**
+   * Handle "delete-download-file" command. Deletes the downloaded file, but
+   * leaves the download in the list.
+   * @param {number} id - ID of download whose file to delete.
+   */
+  self.deleteDownloadFile = id => browser.downloads.removeFile(id).then(() => null);
+
   /**
    * Handle "close-tabs-left" command.
    * @param {number} tabId - ID of tab whose neighbours to close.
@@ -488,6 +1126,168 @@ const Background = function() {
       });
   };
 
+  /**
+   * Handle "close-tab" command.
+   * @param {number} tabId - ID of tab to close.
+   * @return {Promise} - Result of browser.tabs.remove()
+   */
+  self.closeTab = tabId => {
+    console.debug(`closing tab #${tabId} ...`);
+    return browser.tabs.remove(tabId);
+  };
+
+  /**
+   * Handle "close-tabs" command.
+   * @param {number[]} tabIds - IDs of tabs to close.
+   * @return {Promise} - Result of browser.tabs.remove()
+   */
+  self.closeTabs = tabIds => {
+    console.debug(`closing ${tabIds.length} tab(s) ...`);
+    return browser.tabs.remove(tabIds);
+  };
+
+  /**
+   * Handle "duplicate-tab" command.
+   * @param {number} tabId - ID of tab to duplicate.
+   * @return {Promise} - Resolves to Tab for the new tab.
+   */
+  self.duplicateTab = tabId => {
+    return browser.tabs.duplicate(tabId).then(t => Tab(t));
+  };
+
+  /**
+   * Handle "reload-tab" command.
+   * @param {Object} params - Tab ID and options.
+   * @param {number} params.tabId - ID of tab to reload.
+   * @param {boolean} params.bypassCache - Whether to ignore the cache.
+   */
+  self.reloadTab = params => {
+    return browser.tabs.reload(params.tabId, { bypassCache: !!params.bypassCache });
+  };
+
+  /**
+   * Handle "pin-tab" command.
+   * @param {Object} params - Tab ID and state.
+   * @param {number} params.tabId - ID of tab to pin or unpin.
+   * @param {boolean} params.pinned - Whether tab should be pinned.
+   */
+  self.pinTab = params => {
+    return browser.tabs.update(params.tabId, { pinned: !!params.pinned }).then(() => null);
+  };
+
+  /**
+   * Handle "mute-tab" command.
+   * @param {Object} params - Tab ID and state.
+   * @param {number} params.tabId - ID of tab to mute or unmute.
+   * @param {boolean} params.muted - Whether tab should be muted.
+   */
+  self.muteTab = params => {
+    return browser.tabs.update(params.tabId, { muted: !!params.muted }).then(() => null);
+  };
+
+  /**
+   * Handle "discard-tab" command.
+   * @param {number} tabId - ID of tab to unload.
+   * @return {Promise} - Result of browser.tabs.discard()
+   */
+  self.discardTab = tabId => {
+    return browser.tabs.discard(tabId);
+  };
+
+  /**
+   * Handle "move-tab-to-window" command.
+   * @param {Object} params - Tab and window IDs.
+   * @param {number} params.tabId - ID of tab to move.
+   * @param {number} params.windowId - ID of window to move tab to.
+   * If windowId is 0, tab is moved to a new window.
+   */
+  self.moveTabToWindow = params => {
+    if (!params.windowId) {
+      return browser.windows.create({ tabId: params.tabId }).then(() => null);
+    }
+    return browser.tabs
+      .move(params.tabId, { windowId: params.windowId, index: -1 })
+      .then(() => browser.tabs.update(params.tabId, { active: true }))
+      .then(() => null);
+  };
+
+  /**
+   * Handle "move-tabs" command.
+   * @param {Object} params - Tab IDs and destination.
+   * @param {number[]} params.tabIds - IDs of tabs to move, in their new order.
+   * @param {number} params.windowId - ID of window to move tabs to.
+   * @param {number} params.index - Position to move tabs to. -1 is the end.
+   */
+  self.moveTabs = params => {
+    if (!params.tabIds || !params.tabIds.length) return Promise.resolve(null);
+    return browser.tabs
+      .move(params.tabIds, { windowId: params.windowId, index: params.index })
+      .then(() => null);
+  };
+
+  /**
+   * Handle "all-containers" command.
+   * @return {Promise} - Resolves to array of Container objects. The array
+   * is empty if containers are disabled.
+   */
+  self.allContainers = () => {
+    if (!browser.contextualIdentities) return Promise.resolve([]);
+    return browser.contextualIdentities
+      .query({})
+      .then(ids => ids.map(ci => Container(ci)))
+      .catch(err => {
+        // query() fails if containers are disabled
+        console.debug(`containers unavailable: ${err}`);
+        return [];
+      });
+  };
+
+  /**
+   * Handle "reopen-tab-in-container" command.
+   * @param {Object} params - Tab and container IDs.
+   * @param {number} params.tabId - ID of tab to reopen.
+   * @param {string} params.cookieStoreId - ID of container to reopen tab in.
+   * @return {Promise} - Resolves to the new Tab.
+   */
+  self.reopenTabInContainer = params => {
+    return browser.tabs.get(params.tabId).then(tab =>
+      browser.tabs
+        .create({
+          url: tab.url,
+          windowId: tab.windowId,
+          index: tab.index + 1,
+          active: tab.active,
+          pinned: tab.pinned,
+          cookieStoreId: params.cookieStoreId,
+        })
+        .then(t => browser.tabs.remove(tab.id).then(() => Tab(t)))
+    );
+  };
+
+  /**
+   * Handle "recently-closed" command.
+   * @param {number} max - Maximum number of sessions to return.
+   * If 0, the browser's maximum (25) is used.
+   * @return {Promise} - Resolves to array of Session objects, most
+   * recently closed first.
+   */
+  self.recentlyClosed = max => {
+    let opts = {};
+    if (max) opts.maxResults = max;
+    return browser.sessions
+      .getRecentlyClosed(opts)
+      .then(sessions => sessions.map(s => Session(s)));
+  };
+
+  /**
+   * Handle "restore-session" command.
+   * @param {string} sessionId - ID of closed tab or window to restore.
+   * @return {Promise} - Resolves to the restored Session.
+   */
+  self.restoreSession = sessionId => {
+    return browser.sessions.restore(sessionId).then(s => Session(s));
+  };
+
   /** Handle "execute-js" command. */
   // self.executeJS = js => {
   //   return browser.tabs.executeScript({ code: js }).then(results => {
@@ -543,6 +1343,54 @@ const Background = function() {
     return browser.windows.create({ incognito: true, url: url });
   };
 
+  /**
+   * Handle "open-url" command.
+   * @param {Object} params - URL and where to open it.
+   * @param {string} params.url - URL to open. New tab page if empty.
+   * @param {string} params.target - "current", "tab", "background" or "window".
+   * @param {number} params.windowId - ID of window to open URL in.
+   * If 0, the current window is used.
+   * @param {string} params.position - Where to put a new tab: "start", "end",
+   * "next" (after active tab) or "" (browser default).
+   * @param {string} params.cookieStoreId - ID of container to open URL in.
+   * @return {Promise} - Resolves to Tab URL was opened in.
+   */
+  self.openURL = params => {
+    const url = params.url || undefined,
+      cookieStoreId = params.cookieStoreId || undefined,
+      target = params.target || 'tab';
+
+    if (target === 'window') {
+      return browser.windows.create({ url, cookieStoreId }).then(w => Tab(w.tabs[0]));
+    }
+
+    if (target === 'current') {
+      return self.activeTab(params.windowId).then(t => {
+        if (!t) throw 'no current tab';
+        return browser.tabs.update(t.id, { url }).then(t => Tab(t));
+      });
+    }
+
+    const active = target !== 'background';
+    return browser.tabs
+      .query({ windowId: params.windowId || browser.windows.WINDOW_ID_CURRENT })
+      .then(tabs => {
+        let opts = { url, active, cookieStoreId };
+        if (params.windowId) opts.windowId = params.windowId;
+        if (params.position === 'start') opts.index = tabs.filter(t => t.pinned).length;
+        else if (params.position === 'end') opts.index = tabs.length;
+        else if (params.position === 'next') {
+          let t = tabs.find(t => t.active);
+          if (t) opts.index = t.index + 1;
+        }
+        return browser.tabs.create(opts);
+      })
+      .then(t => {
+        if (active && params.windowId) browser.windows.update(params.windowId, { focused: true });
+        return Tab(t);
+      });
+  };
+
   /**
    * Return active tab.
    * @param {number} winId - ID of window to get active tab of.
@@ -563,6 +1411,7 @@ const Background = function() {
   };
 
   browser.runtime.onConnect.addListener(self.onConnected);
+  self.addEventListeners();
   self.connectNative();
   console.log(`started`);
 };
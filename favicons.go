@@ -0,0 +1,226 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	aw "github.com/deanishe/awgo"
+	"github.com/deanishe/awgo/util"
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+const (
+	maxFaviconSize   = 512 * 1024 // ignore larger favicons
+	faviconTimeout   = time.Second * 10
+	faviconFetchers  = 4 // simultaneous downloads
+	faviconJobName   = "favicons"
+	faviconRerunSecs = 0.5
+	faviconRetry     = time.Hour * 24 // how long before retrying a failed favicon
+)
+
+var (
+	// download favicons to cache
+	faviconsCmd = &ffcli.Command{
+		Name:      "favicons",
+		Usage:     "alfred-firefox favicons <url>...",
+		ShortHelp: "cache favicons",
+		LongHelp: wrap(`
+			Download favicons to the workflow's cache directory.
+			Called in the background by the tabs command.
+		`),
+		Exec: runFavicons,
+	}
+
+	// file extensions for data: URL MIME types
+	faviconExts = map[string]string{
+		"image/png":                ".png",
+		"image/jpeg":               ".jpg",
+		"image/gif":                ".gif",
+		"image/svg+xml":            ".svg",
+		"image/x-icon":             ".ico",
+		"image/vnd.microsoft.icon": ".ico",
+	}
+)
+
+// faviconPath returns the path of the cached favicon for URL. The file
+// extension is derived from the URL, as Alfred needs it to show the image.
+func faviconPath(URL string) string {
+	ext := ".ico"
+	if strings.HasPrefix(URL, "data:") {
+		mime := URL[5:]
+		if i := strings.IndexAny(mime, ";,"); i > -1 {
+			mime = mime[:i]
+		}
+		if s, ok := faviconExts[strings.ToLower(mime)]; ok {
+			ext = s
+		}
+	} else if u, err := url.Parse(URL); err == nil {
+		if s := strings.ToLower(path.Ext(u.Path)); imageExts[s] || s == ".svg" || s == ".ico" {
+			ext = s
+		}
+	}
+	h := sha1.Sum([]byte(URL))
+	return filepath.Join(wf.CacheDir(), "favicons", hex.EncodeToString(h[:])+ext)
+}
+
+// favicon returns an icon for the favicon at URL. ok is false if the favicon
+// hasn't been downloaded yet. icon is nil if the favicon couldn't be
+// retrieved. data: URLs are decoded and cached immediately.
+func favicon(URL string) (icon *aw.Icon, ok bool) {
+	if URL == "" {
+		return nil, true
+	}
+	p := faviconPath(URL)
+	if fi, err := os.Stat(p); err == nil {
+		if fi.Size() > 0 {
+			return &aw.Icon{Value: p}, true
+		}
+		// empty file marks a favicon that couldn't be fetched
+		if time.Since(fi.ModTime()) < faviconRetry {
+			return nil, true
+		}
+	}
+	if !strings.HasPrefix(URL, "data:") {
+		return nil, false
+	}
+	if err := cacheFavicon(URL); err != nil {
+		log.Printf("[ERROR] favicon %q: %v", util.PrettyPath(p), err)
+		return nil, true
+	}
+	return &aw.Icon{Value: p}, true
+}
+
+// fetchFavicons downloads favicons in the background and tells Alfred to
+// re-run the Script Filter to show them.
+func fetchFavicons(urls []string) {
+	if len(urls) == 0 {
+		return
+	}
+	wf.Rerun(faviconRerunSecs)
+	if wf.IsRunning(faviconJobName) {
+		return
+	}
+
+	var (
+		args = []string{"favicons"}
+		seen = map[string]bool{}
+	)
+	for _, URL := range urls {
+		if !seen[URL] {
+			seen[URL] = true
+			args = append(args, URL)
+		}
+	}
+	log.Printf("fetching %d favicon(s) in background ...", len(args)-1)
+	cmd := exec.Command(os.Args[0], args...)
+	if err := wf.RunInBackground(faviconJobName, cmd); err != nil {
+		log.Printf("[ERROR] fetch favicons: %v", err)
+	}
+}
+
+// download favicons passed as arguments
+func runFavicons(urls []string) error {
+	useTextErrors()
+	if err := os.MkdirAll(filepath.Join(wf.CacheDir(), "favicons"), 0700); err != nil {
+		return err
+	}
+
+	var (
+		wg   sync.WaitGroup
+		jobs = make(chan string)
+	)
+	for i := 0; i < faviconFetchers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for URL := range jobs {
+				if err := cacheFavicon(URL); err != nil {
+					log.Printf("[ERROR] favicon %q: %v", URL, err)
+				}
+			}
+		}()
+	}
+	for _, URL := range urls {
+		jobs <- URL
+	}
+	close(jobs)
+	wg.Wait()
+	return nil
+}
+
+// cacheFavicon saves the favicon at URL to its faviconPath. If the favicon
+// can't be retrieved, an empty file is saved, so it isn't requested again.
+func cacheFavicon(URL string) error {
+	p := faviconPath(URL)
+	data, fetchErr := loadFavicon(URL)
+	if fetchErr != nil {
+		data = nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	// write to temporary file, so Alfred never sees a partial image
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return err
+	}
+	return fetchErr
+}
+
+// loadFavicon decodes a data: URL or downloads an HTTP URL.
+func loadFavicon(URL string) ([]byte, error) {
+	if strings.HasPrefix(URL, "data:") {
+		i := strings.Index(URL, ",")
+		if i < 0 {
+			return nil, errors.New("invalid data URL")
+		}
+		meta, s := URL[5:i], URL[i+1:]
+		if strings.HasSuffix(meta, ";base64") {
+			return base64.StdEncoding.DecodeString(s)
+		}
+		s, err := url.PathUnescape(s)
+		return []byte(s), err
+	}
+
+	if !strings.HasPrefix(URL, "http://") && !strings.HasPrefix(URL, "https://") {
+		return nil, fmt.Errorf("unsupported URL %q", URL)
+	}
+	client := &http.Client{Timeout: faviconTimeout}
+	r, err := client.Get(URL)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", r.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFaviconSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFaviconSize {
+		return nil, fmt.Errorf("favicon larger than %d bytes", maxFaviconSize)
+	}
+	return data, nil
+}
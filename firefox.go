@@ -4,18 +4,22 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const timeout = time.Second * 5
-
-// errTimeout is returned by firefox.call if execution time exceeds timeout.
+// errTimeout is returned by firefox.call if the command's deadline is exceeded.
 type errTimeout struct {
 	ID string // command ID
 }
@@ -24,6 +28,82 @@ func (err errTimeout) Error() string {
 	return fmt.Sprintf("timeout: %q", err.ID)
 }
 
+// number of events queued for each subscriber before events are dropped.
+const eventBufferSize = 100
+
+// errStopped is returned by firefox.call if the run loop has exited.
+var errStopped = errors.New("extension client stopped")
+
+// errUnsupported is returned if the installed extension doesn't support a command.
+type errUnsupported struct {
+	Command string // name of unsupported command
+	Version string // version of extension; empty if it predates the handshake
+}
+
+func (err errUnsupported) Error() string {
+	v := err.Version
+	if v == "" {
+		v = "< " + minExtensionVersion
+	}
+	return fmt.Sprintf("extension too old, please update: version %s does not support %q", v, err.Command)
+}
+
+// minExtensionVersion is the oldest version of the extension that supports
+// everything the workflow does. Bump it with the version in
+// extension/manifest.json whenever the extension gets new commands.
+const minExtensionVersion = "1.4.0"
+
+// legacyCommands are the commands supported by extensions too old to
+// understand the "hello" handshake.
+var legacyCommands = []string{
+	"ping", "all-tabs", "current-tab", "tab", "all-bookmarks", "search-bookmarks",
+	"search-history", "search-downloads", "activate-tab", "close-tabs-left",
+	"close-tabs-right", "close-tabs-other", "execute-js", "run-bookmarklet",
+	"open-incognito",
+}
+
+// ExtensionInfo describes the installed extension. It is retrieved via
+// the "hello" handshake when the server starts.
+type ExtensionInfo struct {
+	Version  string   `json:"version"`  // extension version; empty if extension predates handshake
+	Commands []string `json:"commands"` // names of commands extension supports
+}
+
+// Supports returns true if extension understands the named command.
+func (info ExtensionInfo) Supports(cmd string) bool {
+	for _, s := range info.Commands {
+		if s == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// Outdated returns true if extension is older than minExtensionVersion.
+func (info ExtensionInfo) Outdated() bool {
+	return info.Version == "" || versionLess(info.Version, minExtensionVersion)
+}
+
+// versionLess returns true if dotted version string a is lower than b.
+// Missing or non-numeric components are treated as 0.
+func versionLess(a, b string) bool {
+	x, y := strings.Split(a, "."), strings.Split(b, ".")
+	for len(x) < len(y) {
+		x = append(x, "0")
+	}
+	for len(y) < len(x) {
+		y = append(y, "0")
+	}
+	for i := range x {
+		m, _ := strconv.Atoi(x[i])
+		n, _ := strconv.Atoi(y[i])
+		if m != n {
+			return m < n
+		}
+	}
+	return false
+}
+
 // command is a command sent to the extension.
 type command struct {
 	ID     string      `json:"id"`
@@ -36,84 +116,149 @@ func (c command) String() string {
 	return fmt.Sprintf("command #%s - %q", c.ID, c.Name)
 }
 
-// encode command into extension STDIO format.
+// encode command into extension STDIO format. Commands too large for
+// a single message are split into several chunks.
 func (c command) encode() ([]byte, error) {
 	js, err := json.Marshal(c)
 	if err != nil {
 		return nil, err
 	}
-	b := make([]byte, 4)
-	binary.LittleEndian.PutUint32(b, uint32(len(js)))
-	b = append(b, js...)
-	return b, nil
+	return frames(c.ID, js)
 }
 
 // response is a generic response from the browser extension.
 // The full JSON response from the extension is contained in data to
 // be unmarshalled by the receiver.
+//
+// Messages pushed by the extension that aren't a response to a command
+// have Event set instead of ID.
 type response struct {
-	ID   string `json:"id"`    // ID of the command this is a response to
-	Err  string `json:"error"` // error message returned by extension
-	data []byte // full JSON response
-	err  error  // error encountered decoding response
+	ID      string          `json:"id"`      // ID of the command this is a response to
+	Event   string          `json:"event"`   // name of event pushed by extension
+	Payload json.RawMessage `json:"payload"` // only decoded for events
+	Err     string          `json:"error"`   // error message returned by extension
+	Chunk   *chunk          `json:"chunk"`   // part of a message too large for one frame
+	data    []byte          // full JSON response
+	err     error           // error encountered decoding response
 }
 
 func (r response) String() string {
+	if r.Event != "" {
+		return fmt.Sprintf("event %q - %d bytes", r.Event, len(r.data))
+	}
 	return fmt.Sprintf("response #%s - %d bytes", r.ID, len(r.data))
 }
 
 // firefox communicates with the browser extension via STDIN/STOUT.
+//
+// Commands may be sent by any number of goroutines. Each command is
+// assigned a unique ID and a handler channel, which is registered
+// before the command is written, so the response can be routed back
+// to the caller. Handlers are removed when the response is received
+// or the caller gives up waiting.
 type firefox struct {
+	stdin     io.Reader // messages from extension
+	stdout    io.Writer // messages to extension
 	commands  chan command
 	responses chan response
 	done      chan struct{}
-	handlers  map[string]chan response
+	stopOnce  sync.Once
+
+	mu       sync.Mutex // protects handlers and readDone
+	handlers map[string]chan response
+	readDone bool // no more responses will be read
+
+	subsMu sync.Mutex // protects subs
+	subs   map[chan Event]struct{}
+
+	infoMu sync.RWMutex   // protects info
+	info   *ExtensionInfo // set by handshake
 }
 
-func newFirefox() *firefox {
+// newFirefox creates a firefox that talks to the extension via the
+// process's STDIN and STDOUT.
+func newFirefox() *firefox { return newFirefoxIO(os.Stdin, os.Stdout) }
+
+// newFirefoxIO creates a firefox that reads extension messages from r
+// and writes commands to w.
+func newFirefoxIO(r io.Reader, w io.Writer) *firefox {
 	return &firefox{
+		stdin:     r,
+		stdout:    w,
 		commands:  make(chan command, 1),
 		responses: make(chan response, 1),
 		done:      make(chan struct{}),
 		handlers:  map[string]chan response{},
+		subs:      map[chan Event]struct{}{},
 	}
 }
 
-// run the read/write loop to send & receive messages from the extension.
-func (f *firefox) run() {
-	go func() {
-		b := make([]byte, 4)
-		for {
-			// read payload size
-			_, err := os.Stdin.Read(b)
-			if err == io.EOF {
-				return
-			}
-			if err != nil {
-				log.Printf("[ERROR] read from stdin: %v", err)
-				return
-			}
+// read responses from the extension and pass them to the run loop.
+// Chunked messages are reassembled before being passed on. When reading
+// stops, calls still waiting for a response fail with errStopped.
+func (f *firefox) read() {
+	var (
+		b   = make([]byte, 4)
+		asm = newAssembler()
+	)
+	defer f.failHandlers(errStopped)
+	for {
+		// read payload size
+		_, err := io.ReadFull(f.stdin, b)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("[ERROR] read from stdin: %v", err)
+			return
+		}
+		// the stream can't be resynchronised after a bad length header
+		n := binary.LittleEndian.Uint32(b)
+		if n > maxReadSize {
+			log.Printf("[ERROR] read from stdin: %v",
+				errCorruptFrame{fmt.Sprintf("frame size %d exceeds %d bytes", n, maxReadSize)})
+			return
+		}
 
-			// read payload
-			data := make([]byte, binary.LittleEndian.Uint32(b))
-			_, err = io.ReadFull(os.Stdin, data)
-			if err == io.EOF {
-				return
-			}
-			if err != nil {
-				log.Printf("[ERROR] read from stdin: %v", err)
-				return
-			}
-			// log.Printf("received %s", data)
-			var r response
-			if err := json.Unmarshal(data, &r); err != nil {
-				r.err = err
+		// read payload
+		data := make([]byte, n)
+		_, err = io.ReadFull(f.stdin, data)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("[ERROR] read from stdin: %v", err)
+			return
+		}
+		// log.Printf("received %s", data)
+		var r response
+		if err := json.Unmarshal(data, &r); err != nil {
+			r.err = errCorruptFrame{err.Error()}
+		} else if r.Chunk != nil {
+			if data, err = asm.add(r.ID, *r.Chunk); err != nil {
+				r = response{ID: r.ID, err: err}
+			} else if data == nil { // message incomplete
+				continue
+			} else {
+				r = response{}
+				if err := json.Unmarshal(data, &r); err != nil {
+					r.err = errCorruptFrame{err.Error()}
+				}
 			}
-			r.data = data
-			log.Printf("received %v", r)
-			f.responses <- r
 		}
-	}()
+		r.data = data
+		log.Printf("received %v", r)
+		select {
+		case f.responses <- r:
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// run the read/write loop to send & receive messages from the extension.
+func (f *firefox) run() {
+	go f.read()
 
 	for {
 		select {
@@ -123,63 +268,221 @@ func (f *firefox) run() {
 		case cmd := <-f.commands:
 			var (
 				data []byte
-				// n    int
-				err error
+				err  error
 			)
 			if data, err = cmd.encode(); err != nil {
-				cmd.ch <- response{err: err}
+				f.dispatch(response{ID: cmd.ID, err: err})
 				break
 			}
-			if _, err = os.Stdout.Write(data); err != nil {
-				cmd.ch <- response{err: err}
+			if _, err = f.stdout.Write(data); err != nil {
+				f.dispatch(response{ID: cmd.ID, err: err})
 				break
 			}
 			log.Printf("sent %v", cmd)
-			f.handlers[cmd.ID] = cmd.ch
 
 		case r := <-f.responses:
-			ch, ok := f.handlers[r.ID]
-			if ok {
-				ch <- r
-				delete(f.handlers, r.ID)
-			} else {
-				log.Printf("[ERROR] no handler for message %q", r.ID)
+			if r.Event != "" && r.ID == "" {
+				f.publish(Event{Name: r.Event, Time: time.Now(), Data: r.Payload})
+				break
 			}
+			f.dispatch(r)
+		}
+	}
+}
+
+// dispatch passes a response to the handler registered for its ID.
+// The handler is removed, so each handler receives at most one response.
+func (f *firefox) dispatch(r response) {
+	f.mu.Lock()
+	ch, ok := f.handlers[r.ID]
+	delete(f.handlers, r.ID)
+	f.mu.Unlock()
+
+	if !ok {
+		log.Printf("[ERROR] no handler for message %q", r.ID)
+		return
+	}
+	// handler channels are buffered and receive only one response,
+	// so this never blocks the run loop
+	ch <- r
+}
+
+// register a handler channel for a command ID. If reading has stopped,
+// the handler receives errStopped immediately.
+func (f *firefox) register(id string) chan response {
+	ch := make(chan response, 1)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.readDone {
+		ch <- response{ID: id, err: errStopped}
+		return ch
+	}
+	f.handlers[id] = ch
+	return ch
+}
+
+// failHandlers passes err to all registered handlers and fails any
+// later ones, as no more responses will arrive.
+func (f *firefox) failHandlers(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readDone = true
+	for id, ch := range f.handlers {
+		ch <- response{ID: id, err: err}
+		delete(f.handlers, id)
+	}
+}
+
+// unregister removes the handler for a command ID.
+func (f *firefox) unregister(id string) {
+	f.mu.Lock()
+	delete(f.handlers, id)
+	f.mu.Unlock()
+}
+
+// handshake asks the extension for its version and supported commands.
+// Extensions that predate the handshake are assumed to support legacyCommands.
+func (f *firefox) handshake(ctx context.Context) (ExtensionInfo, error) {
+	var r struct {
+		Info  ExtensionInfo `json:"payload"`
+		Error string        `json:"error"`
+	}
+	if err := f.call(ctx, "hello", nil, &r); err != nil {
+		return ExtensionInfo{}, err
+	}
+	if r.Error == "unknown command" {
+		r.Info = ExtensionInfo{Commands: legacyCommands}
+	} else if r.Error != "" {
+		return ExtensionInfo{}, errors.New(r.Error)
+	}
+
+	f.infoMu.Lock()
+	f.info = &r.Info
+	f.infoMu.Unlock()
+	return r.Info, nil
+}
+
+// extensionInfo returns the result of the handshake. ok is false if the
+// handshake hasn't completed.
+func (f *firefox) extensionInfo() (info ExtensionInfo, ok bool) {
+	f.infoMu.RLock()
+	defer f.infoMu.RUnlock()
+	if f.info == nil {
+		return ExtensionInfo{}, false
+	}
+	return *f.info, true
+}
+
+// supported returns an errUnsupported if the extension is known not to
+// support the command. If the handshake hasn't completed, all commands
+// are assumed to be supported.
+func (f *firefox) supported(cmd string) error {
+	info, ok := f.extensionInfo()
+	if !ok || info.Supports(cmd) {
+		return nil
+	}
+	return errUnsupported{Command: cmd, Version: info.Version}
+}
+
+// subscribe returns a channel that receives events pushed by the extension.
+// The subscription ends and the channel is closed when ctx is done.
+func (f *firefox) subscribe(ctx context.Context) <-chan Event {
+	ch := make(chan Event, eventBufferSize)
+	f.subsMu.Lock()
+	f.subs[ch] = struct{}{}
+	f.subsMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		f.subsMu.Lock()
+		delete(f.subs, ch)
+		close(ch)
+		f.subsMu.Unlock()
+	}()
+	return ch
+}
+
+// publish passes an event to all subscribers. If a subscriber's buffer is
+// full, the event is dropped for that subscriber rather than holding up
+// the run loop.
+func (f *firefox) publish(ev Event) {
+	f.subsMu.Lock()
+	defer f.subsMu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("[WARNING] subscriber too slow, dropped %v", ev)
 		}
 	}
 }
 
 // call passes a command to the extension and unmarshals the response into pointer v.
 // It returns an error if the command fails, the response isn't understood or
-// the respones takes too long.
-func (f *firefox) call(cmd string, params, v interface{}) error {
+// ctx is done before the response arrives. If ctx is cancelled or its deadline
+// passes, the extension is told to discard the command's response.
+// It is safe to call from multiple goroutines.
+func (f *firefox) call(ctx context.Context, cmd string, params, v interface{}) error {
 	c := command{
 		ID:     newID(),
 		Name:   cmd,
 		Params: params,
-		ch:     make(chan response),
 	}
-	f.commands <- c
+	// register handler before sending the command, so a fast response
+	// can't arrive before there's somebody to receive it
+	c.ch = f.register(c.ID)
+	// handler is a no-op if it's already been removed by dispatch
+	defer f.unregister(c.ID)
+
+	select {
+	case f.commands <- c:
+	case <-f.done:
+		return errStopped
+	case <-ctx.Done():
+		return contextError(ctx, c.ID)
+	}
 
-	t := time.Tick(timeout)
 	select {
 	case r := <-c.ch:
 		if r.err != nil {
 			return r.err
 		}
 		return json.Unmarshal(r.data, v)
-	case <-t:
-		return errTimeout{c.ID}
+	case <-f.done:
+		return errStopped
+	case <-ctx.Done():
+		go f.cancel(c.ID)
+		return contextError(ctx, c.ID)
+	}
+}
+
+// cancel tells the extension to discard the response to an abandoned command.
+// The extension doesn't reply to "cancel" commands.
+func (f *firefox) cancel(id string) {
+	if f.supported("cancel") != nil {
+		return
+	}
+	c := command{ID: newID(), Name: "cancel", Params: id}
+	select {
+	case f.commands <- c:
+	case <-f.done:
+	}
+}
+
+// contextError returns the error for a command abandoned because ctx is done.
+func contextError(ctx context.Context, id string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errTimeout{id}
 	}
+	return ctx.Err()
 }
 
-// exist the run loop.
-func (f *firefox) stop() { close(f.done) }
+// exit the run loop. Safe to call more than once.
+func (f *firefox) stop() { f.stopOnce.Do(func() { close(f.done) }) }
 
-var lastUID = 0
+var lastUID uint64
 
-// create a new command ID.
+// create a new command ID. Safe for concurrent use.
 func newID() string {
-	lastUID++
-	return fmt.Sprintf("%d.%d", time.Now().Unix(), lastUID)
+	return fmt.Sprintf("%d.%d", time.Now().Unix(), atomic.AddUint64(&lastUID, 1))
 }
@@ -0,0 +1,154 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// Size limits for native messages. Firefox refuses messages from the native
+// application larger than 1 MB, so bigger messages are split into chunks.
+// The extension does the same with large responses.
+const (
+	maxFrameSize   = 1024 * 1024       // largest frame sent to Firefox
+	chunkSize      = 512 * 1024        // bytes of message per chunk (before base64 encoding)
+	maxReadSize    = 64 * 1024 * 1024  // largest frame accepted from Firefox
+	maxMessageSize = 128 * 1024 * 1024 // largest message after reassembly
+)
+
+// errCorruptFrame is returned if a message from the extension is invalid
+// or can't be reassembled.
+type errCorruptFrame struct {
+	Reason string
+}
+
+func (err errCorruptFrame) Error() string {
+	return "corrupt frame: " + err.Reason
+}
+
+// chunk is part of a message too large to send in a single frame. The
+// chunk is wrapped in a message with the ID of the message it belongs to.
+// Data is base64-encoded when marshalled to JSON.
+type chunk struct {
+	Index int    `json:"index"` // position of chunk in message
+	Count int    `json:"count"` // total number of chunks in message
+	Data  []byte `json:"data"`  // part of JSON-encoded message
+}
+
+// chunkMessage is a frame containing a chunk.
+type chunkMessage struct {
+	ID    string `json:"id"`
+	Chunk chunk  `json:"chunk"`
+}
+
+// frame prefixes data with its length in native messaging format.
+func frame(data []byte) []byte {
+	b := make([]byte, 4, len(data)+4)
+	binary.LittleEndian.PutUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+// frames encodes the JSON message js as one or more native messaging frames.
+// If js is too large for a single frame, it is split into chunks.
+func frames(id string, js []byte) ([]byte, error) {
+	if len(js) > maxMessageSize {
+		return nil, fmt.Errorf("message too large: %d bytes (max %d)", len(js), maxMessageSize)
+	}
+	if len(js) <= maxFrameSize {
+		return frame(js), nil
+	}
+
+	var (
+		buf   bytes.Buffer
+		count = (len(js) + chunkSize - 1) / chunkSize
+	)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(js) {
+			end = len(js)
+		}
+		data, err := json.Marshal(chunkMessage{
+			ID:    id,
+			Chunk: chunk{Index: i, Count: count, Data: js[i*chunkSize : end]},
+		})
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(frame(data))
+	}
+	return buf.Bytes(), nil
+}
+
+// assembler reassembles chunked messages from the extension. It is not
+// safe for concurrent use.
+type assembler struct {
+	partial map[string]*assembly
+	size    int // total bytes held in partial
+}
+
+// assembly is a partially-received message.
+type assembly struct {
+	chunks   [][]byte
+	received int
+	size     int
+}
+
+func newAssembler() *assembler {
+	return &assembler{partial: map[string]*assembly{}}
+}
+
+// add a chunk of message id. If the chunk completes the message, the
+// reassembled message is returned. An error is returned if the chunk
+// doesn't fit the rest of the message, in which case the partial message
+// is discarded.
+func (a *assembler) add(id string, c chunk) ([]byte, error) {
+	if c.Count < 1 || c.Index < 0 || c.Index >= c.Count {
+		a.discard(id)
+		return nil, errCorruptFrame{fmt.Sprintf("chunk %d/%d of message %q", c.Index, c.Count, id)}
+	}
+
+	m, ok := a.partial[id]
+	if !ok {
+		m = &assembly{chunks: make([][]byte, c.Count)}
+		a.partial[id] = m
+	}
+	if len(m.chunks) != c.Count {
+		a.discard(id)
+		return nil, errCorruptFrame{fmt.Sprintf("message %q: chunk count changed from %d to %d",
+			id, len(m.chunks), c.Count)}
+	}
+	if m.chunks[c.Index] != nil {
+		a.discard(id)
+		return nil, errCorruptFrame{fmt.Sprintf("message %q: duplicate chunk %d", id, c.Index)}
+	}
+	if a.size+len(c.Data) > maxMessageSize {
+		a.discard(id)
+		return nil, errCorruptFrame{fmt.Sprintf("message %q exceeds %d bytes", id, maxMessageSize)}
+	}
+
+	if c.Data == nil { // distinguish empty chunk from missing one
+		c.Data = []byte{}
+	}
+	m.chunks[c.Index] = c.Data
+	m.received++
+	m.size += len(c.Data)
+	a.size += len(c.Data)
+	if m.received < len(m.chunks) {
+		return nil, nil
+	}
+
+	a.discard(id)
+	return bytes.Join(m.chunks, nil), nil
+}
+
+// discard partially-received message id.
+func (a *assembler) discard(id string) {
+	if m, ok := a.partial[id]; ok {
+		a.size -= m.size
+		delete(a.partial, id)
+	}
+}
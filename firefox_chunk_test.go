@@ -0,0 +1,185 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// splitFrames returns the payloads of native messaging frames in data.
+func splitFrames(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	var payloads [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			t.Fatalf("truncated frame header: %d bytes", len(data))
+		}
+		n := int(binary.LittleEndian.Uint32(data))
+		if n > len(data)-4 {
+			t.Fatalf("truncated frame: want %d bytes, have %d", n, len(data)-4)
+		}
+		payloads = append(payloads, data[4:4+n])
+		data = data[4+n:]
+	}
+	return payloads
+}
+
+// Large messages are split into chunks that fit in a frame and can be
+// reassembled in any order.
+func TestFrames(t *testing.T) {
+	small := []byte(`{"id":"1","payload":"hello"}`)
+	data, err := frames("1", small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := splitFrames(t, data); len(p) != 1 || !bytes.Equal(p[0], small) {
+		t.Errorf("small message: expected one frame containing message, got %d frame(s)", len(p))
+	}
+
+	big, err := json.Marshal(map[string]string{"id": "2", "payload": strings.Repeat("héllo wörld ", 200000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err = frames("2", big); err != nil {
+		t.Fatal(err)
+	}
+	payloads := splitFrames(t, data)
+	if len(payloads) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(payloads))
+	}
+
+	asm := newAssembler()
+	var msg []byte
+	for i := len(payloads) - 1; i >= 0; i-- { // out of order
+		if len(payloads[i]) > maxFrameSize {
+			t.Errorf("chunk %d: frame of %d bytes exceeds %d", i, len(payloads[i]), maxFrameSize)
+		}
+		var cm chunkMessage
+		if err := json.Unmarshal(payloads[i], &cm); err != nil {
+			t.Fatal(err)
+		}
+		if cm.ID != "2" {
+			t.Errorf("chunk %d: expected ID %q, got %q", i, "2", cm.ID)
+		}
+		if msg, err = asm.add(cm.ID, cm.Chunk); err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && msg != nil {
+			t.Fatalf("message complete after %d of %d chunks", len(payloads)-i, len(payloads))
+		}
+	}
+	if !bytes.Equal(msg, big) {
+		t.Error("reassembled message differs from original")
+	}
+}
+
+// chunkIn is a chunk received by an assembler.
+type chunkIn struct {
+	id    string
+	chunk chunk
+	x     string // expected message ("" if incomplete)
+	err   bool   // whether an error is expected
+}
+
+func TestAssembler(t *testing.T) {
+	c := func(id string, index, count int, data, x string) chunkIn {
+		return chunkIn{id: id, chunk: chunk{Index: index, Count: count, Data: []byte(data)}, x: x}
+	}
+	bad := func(id string, index, count int) chunkIn {
+		return chunkIn{id: id, chunk: chunk{Index: index, Count: count, Data: []byte("x")}, err: true}
+	}
+
+	tests := []struct {
+		name    string
+		in      []chunkIn
+		partial int // messages left incomplete
+	}{
+		{"single chunk", []chunkIn{c("a", 0, 1, "abc", "abc")}, 0},
+		{"in order", []chunkIn{c("a", 0, 3, "ab", ""), c("a", 1, 3, "cd", ""), c("a", 2, 3, "e", "abcde")}, 0},
+		{"out of order", []chunkIn{c("a", 2, 3, "e", ""), c("a", 0, 3, "ab", ""), c("a", 1, 3, "cd", "abcde")}, 0},
+		{"empty chunk", []chunkIn{c("a", 0, 2, "", ""), c("a", 1, 2, "ab", "ab")}, 0},
+		{"missing chunk", []chunkIn{c("a", 0, 3, "ab", ""), c("a", 2, 3, "e", "")}, 1},
+		{"duplicate chunk", []chunkIn{c("a", 0, 2, "ab", ""), bad("a", 0, 2)}, 0},
+		{"duplicate discards message", []chunkIn{
+			c("a", 0, 2, "ab", ""), bad("a", 0, 2), c("a", 1, 2, "cd", ""),
+		}, 1},
+		{"index too large", []chunkIn{bad("a", 2, 2)}, 0},
+		{"negative index", []chunkIn{bad("a", -1, 2)}, 0},
+		{"zero count", []chunkIn{bad("a", 0, 0)}, 0},
+		{"count changed", []chunkIn{c("a", 0, 2, "ab", ""), bad("a", 1, 3)}, 0},
+		{"interleaved IDs", []chunkIn{
+			c("a", 0, 2, "ab", ""),
+			c("b", 1, 2, "CD", ""),
+			c("b", 0, 2, "AB", "ABCD"),
+			c("a", 1, 2, "cd", "abcd"),
+		}, 0},
+		{"error leaves other IDs", []chunkIn{
+			c("a", 0, 2, "ab", ""),
+			c("b", 0, 2, "AB", ""),
+			bad("b", 0, 2),
+			c("a", 1, 2, "cd", "abcd"),
+		}, 0},
+	}
+
+	for _, td := range tests {
+		td := td
+		t.Run(td.name, func(t *testing.T) {
+			asm := newAssembler()
+			for i, in := range td.in {
+				msg, err := asm.add(in.id, in.chunk)
+				if in.err {
+					if _, ok := err.(errCorruptFrame); !ok {
+						t.Fatalf("chunk %d: expected errCorruptFrame, got %v", i, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("chunk %d: %v", i, err)
+				}
+				if string(msg) != in.x {
+					t.Fatalf("chunk %d: expected message %q, got %q", i, in.x, msg)
+				}
+			}
+			if n := len(asm.partial); n != td.partial {
+				t.Errorf("expected %d partial message(s), got %d", td.partial, n)
+			}
+			if td.partial == 0 && asm.size != 0 {
+				t.Errorf("expected size 0, got %d", asm.size)
+			}
+		})
+	}
+}
+
+// Chunks that would take partial messages over maxMessageSize are rejected.
+func TestAssemblerMaxSize(t *testing.T) {
+	const size = 1024 * 1024
+	var (
+		asm   = newAssembler()
+		data  = make([]byte, size) // shared by all chunks
+		count = maxMessageSize/size + 1
+	)
+	for i := 0; i < count-1; i++ {
+		if _, err := asm.add("a", chunk{Index: i, Count: count, Data: data}); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+	}
+	if asm.size != maxMessageSize {
+		t.Fatalf("expected %d bytes held, got %d", maxMessageSize, asm.size)
+	}
+
+	// limit applies to all partial messages, not just one
+	if _, err := asm.add("b", chunk{Index: 0, Count: 2, Data: []byte("x")}); err == nil {
+		t.Error("expected error for chunk of another message over limit")
+	}
+	if _, err := asm.add("a", chunk{Index: count - 1, Count: count, Data: []byte("x")}); err == nil {
+		t.Fatal("expected error for message over limit")
+	}
+	if len(asm.partial) != 0 || asm.size != 0 {
+		t.Errorf("oversize message not discarded: %d partial message(s), %d bytes", len(asm.partial), asm.size)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCommand is a command received by fakeExtension.
+type fakeCommand struct {
+	ID     string          `json:"id"`
+	Name   string          `json:"command"`
+	Params json.RawMessage `json:"params"`
+}
+
+// fakeExtension is the browser end of a firefox's STDIO connection.
+// Tests receive the commands it reads and decide when to reply.
+type fakeExtension struct {
+	t        *testing.T
+	commands chan fakeCommand
+	w        io.WriteCloser // responses to firefox
+	r        io.ReadCloser  // commands from firefox
+}
+
+// newFakeExtension starts a firefox connected to a fakeExtension. Call
+// the returned function to shut both down.
+func newFakeExtension(t *testing.T) (*firefox, *fakeExtension, func()) {
+	cmdR, cmdW := io.Pipe()
+	respR, respW := io.Pipe()
+	f := newFirefoxIO(respR, cmdW)
+	ext := &fakeExtension{t: t, commands: make(chan fakeCommand, 100), w: respW, r: cmdR}
+	go ext.read()
+	go f.run()
+	return f, ext, func() {
+		f.stop()
+		respW.Close()
+		cmdR.Close()
+	}
+}
+
+// read commands sent by firefox.
+func (ext *fakeExtension) read() {
+	b := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(ext.r, b); err != nil {
+			close(ext.commands)
+			return
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(b))
+		if _, err := io.ReadFull(ext.r, data); err != nil {
+			close(ext.commands)
+			return
+		}
+		var c fakeCommand
+		if err := json.Unmarshal(data, &c); err != nil {
+			ext.t.Errorf("unmarshal command: %v", err)
+		}
+		ext.commands <- c
+	}
+}
+
+// recv returns the next command sent by firefox.
+func (ext *fakeExtension) recv() fakeCommand {
+	ext.t.Helper()
+	select {
+	case c := <-ext.commands:
+		return c
+	case <-time.After(time.Second * 2):
+		ext.t.Fatal("no command received")
+		return fakeCommand{}
+	}
+}
+
+// reply sends a response with the given payload to command id.
+func (ext *fakeExtension) reply(id string, payload interface{}) {
+	ext.t.Helper()
+	js, err := json.Marshal(map[string]interface{}{"id": id, "payload": payload})
+	if err != nil {
+		ext.t.Fatal(err)
+	}
+	if _, err := ext.w.Write(frame(js)); err != nil {
+		ext.t.Fatalf("write response: %v", err)
+	}
+}
+
+// handlerCount returns the number of registered response handlers.
+func (f *firefox) handlerCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.handlers)
+}
+
+type intResponse struct {
+	N int `json:"payload"`
+}
+
+// Responses to concurrent calls are routed to the right caller, whatever
+// order they arrive in.
+func TestCallOutOfOrder(t *testing.T) {
+	f, ext, stop := newFakeExtension(t)
+	defer stop()
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var r intResponse
+			if err := f.call(context.Background(), "echo", i, &r); err != nil {
+				t.Errorf("call %d: %v", i, err)
+				return
+			}
+			if r.N != i {
+				t.Errorf("call %d: got response %d", i, r.N)
+			}
+		}(i)
+	}
+
+	cmds := make([]fakeCommand, n)
+	for i := range cmds {
+		cmds[i] = ext.recv()
+	}
+	// reply in reverse order
+	for i := n - 1; i >= 0; i-- {
+		v, err := strconv.Atoi(string(cmds[i].Params))
+		if err != nil {
+			t.Fatalf("bad params %q: %v", cmds[i].Params, err)
+		}
+		ext.reply(cmds[i].ID, v)
+	}
+	wg.Wait()
+
+	if x := f.handlerCount(); x != 0 {
+		t.Errorf("%d handler(s) left after calls completed", x)
+	}
+}
+
+// A call that times out removes its handler and tells the extension to
+// cancel the command. A late response is dropped without affecting
+// other calls.
+func TestCallTimeout(t *testing.T) {
+	f, ext, stop := newFakeExtension(t)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err := f.call(ctx, "slow", 1, &intResponse{})
+	if _, ok := err.(errTimeout); !ok {
+		t.Fatalf("expected errTimeout, got %v", err)
+	}
+	if x := f.handlerCount(); x != 0 {
+		t.Errorf("%d handler(s) left after timeout", x)
+	}
+
+	slow := ext.recv()
+	if slow.Name != "slow" {
+		t.Fatalf("expected slow command, got %q", slow.Name)
+	}
+	c := ext.recv()
+	if c.Name != "cancel" {
+		t.Fatalf("expected cancel command, got %q", c.Name)
+	}
+	var id string
+	if err := json.Unmarshal(c.Params, &id); err != nil || id != slow.ID {
+		t.Errorf("cancel: expected ID %q, got %s", slow.ID, c.Params)
+	}
+
+	// late response
+	ext.reply(slow.ID, 1)
+
+	done := make(chan error, 1)
+	var r intResponse
+	go func() { done <- f.call(context.Background(), "echo", 2, &r) }()
+	echo := ext.recv()
+	ext.reply(echo.ID, 2)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("call blocked after late response")
+	}
+	if r.N != 2 {
+		t.Errorf("expected response 2, got %d", r.N)
+	}
+}
+
+// Cancellation isn't sent to extensions that don't support it.
+func TestCallCancelUnsupported(t *testing.T) {
+	f, ext, stop := newFakeExtension(t)
+	defer stop()
+	f.infoMu.Lock()
+	f.info = &ExtensionInfo{Version: "1.0", Commands: []string{"slow", "echo"}}
+	f.infoMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- f.call(ctx, "slow", 1, &intResponse{}) }()
+	ext.recv() // slow
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// next command must be echo, not cancel
+	go func() { done <- f.call(context.Background(), "echo", 3, &intResponse{}) }()
+	c := ext.recv()
+	if c.Name != "echo" {
+		t.Fatalf("expected echo command, got %q", c.Name)
+	}
+	ext.reply(c.ID, 3)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Calls waiting for a response fail with errStopped when the extension
+// closes the connection, as do later calls.
+func TestCallReadStopped(t *testing.T) {
+	f, ext, stop := newFakeExtension(t)
+	defer stop()
+
+	const n = 5
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) { errs <- f.call(context.Background(), "echo", i, &intResponse{}) }(i)
+	}
+	for i := 0; i < n; i++ {
+		ext.recv()
+	}
+	ext.w.Close()
+
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errs:
+			if err != errStopped {
+				t.Errorf("expected errStopped, got %v", err)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatal("call blocked after extension closed connection")
+		}
+	}
+	if x := f.handlerCount(); x != 0 {
+		t.Errorf("%d handler(s) left after extension closed connection", x)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := f.call(ctx, "echo", 0, &intResponse{}); err != errStopped {
+		t.Errorf("expected errStopped after extension closed connection, got %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+const (
+	// maximum number of pages ForgetSite and the forget command
+	// look at
+	forgetMaxResults = 10000
+	// how forget command shows since: and before: times
+	forgetTimeFormat = "2 Jan 2006 15:04"
+)
+
+var (
+	// delete history entries
+	forgetCmd = &ffcli.Command{
+		Name: "forget",
+		Usage: "alfred-firefox -query <domain> [since:<time>] [before:<time>] forget\n" +
+			"  alfred-firefox -query <query> -action delete forget\n" +
+			"  alfred-firefox -url <url> -action delete-url forget",
+		ShortHelp: "delete history for a site or time range",
+		LongHelp: wrap(`
+			Show what history for a domain (and its subdomains)
+			and/or time range would be deleted. With -action delete,
+			delete it. Only visits in the time range are deleted,
+			and pages with no other visits are removed. With
+			-action delete-url, delete the URL given by -url from
+			history.
+		`),
+		Exec: runForget,
+	}
+)
+
+// historyQuery is a history search query parsed by parseHistoryQuery.
+type historyQuery struct {
+	Text   string    // rest of query, searched for by Firefox
+	Site   string    // from site:<domain>
+	Since  time.Time // from since:<time>
+	Before time.Time // from before:<time>
+}
+
+// filtered returns true if query filters by site or date.
+func (hq historyQuery) filtered() bool {
+	return hq.Site != "" || !hq.Since.IsZero() || !hq.Before.IsZero()
+}
+
+// arg returns the SearchHistory parameters for the query. The site is also
+// searched for, as Firefox matches text against URLs, too.
+func (hq historyQuery) arg() SearchHistoryArg {
+	arg := SearchHistoryArg{Text: strings.TrimSpace(hq.Text + " " + hq.Site)}
+	if !hq.Since.IsZero() {
+		arg.StartTime = hq.Since.UnixNano() / int64(time.Millisecond)
+	}
+	if !hq.Before.IsZero() {
+		arg.EndTime = hq.Before.UnixNano() / int64(time.Millisecond)
+	}
+	return arg
+}
+
+// match returns true if entry is on the query's site or one of its
+// subdomains.
+func (hq historyQuery) match(h History) bool {
+	if hq.Site == "" {
+		return true
+	}
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == hq.Site || strings.HasSuffix(host, "."+hq.Site)
+}
+
+// parseHistoryQuery splits "site:<domain>", "since:<time>" and
+// "before:<time>" filters from the rest of query. Times are relative to
+// now; see parseHistoryTime.
+func parseHistoryQuery(q string, now time.Time) (historyQuery, error) {
+	var (
+		hq    historyQuery
+		words []string
+		err   error
+	)
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+		var word string
+		word, q = nextQueryWord(q)
+		switch lower := strings.ToLower(word); {
+		case strings.HasPrefix(lower, "site:"):
+			hq.Site = strings.TrimPrefix(strings.ToLower(unquote(word[5:])), "www.")
+		case strings.HasPrefix(lower, "since:"):
+			if hq.Since, err = parseHistoryTime(word[6:], now); err != nil {
+				return hq, err
+			}
+		case strings.HasPrefix(lower, "before:"):
+			if hq.Before, err = parseHistoryTime(word[7:], now); err != nil {
+				return hq, err
+			}
+		default:
+			words = append(words, word)
+		}
+	}
+	hq.Text = strings.Join(words, " ")
+	return hq, nil
+}
+
+// parseForgetQuery parses the query of the forget command: a domain, with
+// or without "site:", and/or since: and before: filters.
+func parseForgetQuery(q string, now time.Time) (historyQuery, error) {
+	hq, err := parseHistoryQuery(q, now)
+	if err != nil || hq.Text == "" {
+		return hq, err
+	}
+	if hq.Site != "" || strings.ContainsAny(hq.Text, " \t") {
+		return hq, errors.New("enter a single domain")
+	}
+	hq.Site = strings.TrimPrefix(strings.ToLower(hq.Text), "www.")
+	hq.Text = ""
+	return hq, nil
+}
+
+// siteHistory returns the entries on domain or its subdomains.
+func siteHistory(history []History, domain string) []History {
+	var (
+		hq      = historyQuery{Site: strings.TrimPrefix(strings.ToLower(domain), "www.")}
+		matches []History
+	)
+	for _, h := range history {
+		if hq.match(h) {
+			matches = append(matches, h)
+		}
+	}
+	return matches
+}
+
+// parseHistoryTime parses a date (YYYY-MM-DD, local time) or a duration
+// before now in hours, days or weeks, e.g. "12h", "7d" or "2w". An empty
+// string returns the zero time.
+func parseHistoryTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	s = strings.ToLower(s)
+	if t, err := time.ParseInLocation("2006-01-02", s, now.Location()); err == nil {
+		return t, nil
+	}
+
+	units := map[byte]time.Duration{
+		'h': time.Hour,
+		'd': time.Hour * 24,
+		'w': time.Hour * 24 * 7,
+	}
+	if unit, ok := units[s[len(s)-1]]; ok {
+		if n, err := strconv.Atoi(s[:len(s)-1]); err == nil && n >= 0 {
+			return now.Add(-time.Duration(n) * unit), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use a date (YYYY-MM-DD) or e.g. 12h, 7d or 2w", s)
+}
+
+// describe returns a description of the query's domain and time range,
+// e.g. "github.com since 2 Jan 2025".
+func (hq historyQuery) describe() string {
+	var parts []string
+	if hq.Site != "" {
+		parts = append(parts, hq.Site)
+	} else {
+		parts = append(parts, "all sites")
+	}
+	if !hq.Since.IsZero() {
+		parts = append(parts, "since "+hq.Since.Format(forgetTimeFormat))
+	}
+	if !hq.Before.IsZero() {
+		parts = append(parts, "before "+hq.Before.Format(forgetTimeFormat))
+	}
+	return strings.Join(parts, " ")
+}
+
+// list history entries that would be deleted and ask for confirmation
+func runForget(_ []string) error {
+	switch action {
+	case "delete":
+		return forgetHistory()
+	case "delete-url":
+		useTextErrors()
+		if URL == "" {
+			return errors.New("no URL")
+		}
+		log.Printf("deleting %q from history ...", URL)
+		if err := mustClient().DeleteHistoryURL(URL); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted “%s” from history\n", URL)
+		return nil
+	default:
+		return listForget()
+	}
+}
+
+// show what history the forget query would delete
+func listForget() error {
+	hq, err := parseForgetQuery(query, time.Now())
+	if err != nil {
+		wf.Warn("Invalid Query", err.Error())
+		return nil
+	}
+	if !hq.filtered() {
+		wf.NewItem("Enter a Domain and/or Time Range").
+			Subtitle("e.g. example.com, example.com since:7d or since:1h").
+			Icon(iconHistory)
+		wf.SendFeedback()
+		return nil
+	}
+
+	var (
+		c   = mustClient()
+		arg = hq.arg()
+		sub = "↩ to delete all visits to all sites in this time range"
+	)
+	if hq.Site != "" {
+		res, err := c.ForgetSite(ForgetSiteArg{
+			Domain:    hq.Site,
+			StartTime: arg.StartTime,
+			EndTime:   arg.EndTime,
+			DryRun:    true,
+		})
+		if err != nil {
+			return err
+		}
+		if res.Pages+res.Visits == 0 {
+			wf.Warn("No History for "+hq.describe(), "Try a different domain or time range?")
+			return nil
+		}
+		sub = "↩ to delete " + describeForget(res)
+		if res.Truncated {
+			sub += fmt.Sprintf(" (first %d pages only)", forgetMaxResults)
+		}
+	}
+
+	arg.MaxResults = forgetMaxResults
+	history, err := c.SearchHistory(arg)
+	if err != nil {
+		return err
+	}
+	if hq.Site != "" {
+		history = siteHistory(history, hq.Site)
+	}
+	if len(history) == 0 && hq.Site == "" {
+		wf.Warn("No History for "+hq.describe(), "Try a different domain or time range?")
+		return nil
+	}
+
+	wf.NewItem(fmt.Sprintf("Forget %s", hq.describe())).
+		Subtitle(sub).
+		Valid(true).
+		Icon(iconWarning).
+		Var("CMD", "forget").
+		Var("ACTION", "delete").
+		Var("QUERY", query)
+
+	for _, h := range history {
+		wf.NewItem(h.Title).
+			Subtitle(fmt.Sprintf("Visited %s · %s", relativeTime(h.LastVisit()), h.URL)).
+			Icon(iconHistory)
+	}
+	wf.SendFeedback()
+	return nil
+}
+
+// delete the history entries matched by the forget query
+func forgetHistory() error {
+	useTextErrors()
+	hq, err := parseForgetQuery(query, time.Now())
+	if err != nil {
+		return err
+	}
+	arg := hq.arg()
+	c := mustClient()
+
+	if hq.Site == "" {
+		if !hq.filtered() {
+			return errors.New("no domain or time range")
+		}
+		log.Printf("deleting history %s ...", hq.describe())
+		if err := c.DeleteHistoryRange(arg.StartTime, arg.EndTime); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted history %s\n", strings.TrimPrefix(hq.describe(), "all sites "))
+		return nil
+	}
+
+	log.Printf("forgetting %s ...", hq.describe())
+	res, err := c.ForgetSite(ForgetSiteArg{Domain: hq.Site, StartTime: arg.StartTime, EndTime: arg.EndTime})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %s from history\n", describeForget(res))
+	if res.Truncated {
+		fmt.Printf("Stopped after %d pages. Run forget again to delete the rest.\n", forgetMaxResults)
+	}
+	return nil
+}
+
+// describeForget returns what a ForgetSite call deleted, e.g. "2 pages
+// and 5 visits to other pages".
+func describeForget(res ForgetSiteResult) string {
+	var parts []string
+	if res.Pages > 0 || res.Visits == 0 {
+		parts = append(parts, pluralise(res.Pages, "page", "pages"))
+	}
+	if res.Visits > 0 {
+		s := pluralise(res.Visits, "visit", "visits")
+		if res.Pages > 0 {
+			s += " to other pages"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " and ")
+}
@@ -0,0 +1,795 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maximum size of an HTTP request body
+const maxRequestBody = 1024 * 1024
+
+// tokenFile returns the path of the file containing the HTTP gateway's
+// bearer token.
+func tokenFile() string { return filepath.Join(wf.DataDir(), "http-token") }
+
+// loadToken reads the HTTP gateway's bearer token, creating the token file
+// if it doesn't exist.
+func loadToken() (string, error) {
+	path := tokenFile()
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	log.Printf("created HTTP token in %q", path)
+	return token, nil
+}
+
+// httpServer is a REST gateway to the RPC API for programs that can't use
+// JSON-RPC over a UNIX socket. Clients must send the token in tokenFile
+// in an "Authorization: Bearer <token>" header. See doc/http.md.
+type httpServer struct {
+	ff     *firefox
+	token  string
+	server *http.Server
+}
+
+// create a new HTTP gateway listening on addr, which must be a loopback address.
+func newHTTPService(addr string, client *firefox) (*httpServer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("HTTP server must listen on localhost, not %q", host)
+	}
+
+	token, err := loadToken()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &httpServer{ff: client, token: token}
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	return s, nil
+}
+
+// serve HTTP until the server is stopped.
+func (s *httpServer) run() {
+	log.Printf("serving HTTP on %q ...", s.server.Addr)
+	if err := s.server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Printf("[ERROR] HTTP server: %v", err)
+	}
+}
+
+func (s *httpServer) stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// errHTTP is an HTTP error not caused by an RPC call.
+type errHTTP struct {
+	Status  int
+	Message string
+}
+
+func (err errHTTP) Error() string { return err.Message }
+
+// ServeHTTP implements http.Handler.
+func (s *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="alfred-firefox"`)
+		s.writeError(w, r, errHTTP{http.StatusUnauthorized, "invalid or missing token"})
+		return
+	}
+
+	// each request gets its own rpcServer, so calls are abandoned if the
+	// client goes away
+	svc := &rpcServer{ff: s.ff, ctx: r.Context()}
+	v, err := s.route(svc, r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	log.Printf("[http] %s %s", r.Method, r.URL.Path)
+
+	if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var data []byte
+	if js, ok := v.(json.RawMessage); ok {
+		data = js
+	} else if data, err = json.Marshal(v); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(data, '\n'))
+}
+
+// authorized returns true if request has a valid bearer token.
+func (s *httpServer) authorized(r *http.Request) bool {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return false
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// route calls the rpcServer method corresponding to the request. It returns
+// the value to send to the client, or nil if there is no response body.
+//
+//	GET  /ping
+//	GET  /extension
+//	GET  /windows
+//	POST /windows                         {"url": "...", "incognito": false}
+//	POST /windows/<id>/focus
+//	POST /windows/<id>/minimize
+//	POST /windows/<id>/close
+//	GET  /containers
+//	GET  /tabs
+//	GET  /tabs/<id>                       # <id> may be "active"
+//	POST /tabs/<id>/activate
+//	POST /tabs/<id>/close-left
+//	POST /tabs/<id>/close-right
+//	POST /tabs/<id>/close-other
+//	POST /tabs/<id>/close
+//	POST /tabs/<id>/duplicate
+//	POST /tabs/<id>/reopen                {"cookieStoreId": "..."}
+//	POST /tabs/<id>/reload                {"bypassCache": false}
+//	POST /tabs/<id>/pin                   {"pinned": true}
+//	POST /tabs/<id>/mute                  {"muted": true}
+//	POST /tabs/<id>/discard
+//	POST /tabs/<id>/move                  {"windowId": 0}
+//	POST /tabs/<id>/run-js                {"js": "..."}
+//	POST /tabs/<id>/run-bookmarklet       {"bookmarkId": "..."}
+//	POST /close-tabs                      {"tabIds": [1, 2]}
+//	POST /move-tabs                       {"tabIds": [1, 2], "windowId": 3, "index": 0}
+//	GET  /bookmarks?q=<query>
+//	POST /bookmarks                       {"parentId": "...", "title": "...", "url": "..."}
+//	POST /bookmarks/<id>/update           {"title": "...", "url": "..."}
+//	POST /bookmarks/<id>/move             {"parentId": "...", "index": -1}
+//	POST /bookmarks/<id>/delete
+//	GET  /bookmark-tree
+//	GET  /history?q=<query>[&start=<ms>][&end=<ms>][&max=<n>]
+//	GET  /visits?url=<url>|domain=<domain>[&start=<ms>][&end=<ms>]
+//	POST /history/delete                  {"url": "..."}
+//	POST /history/delete-range            {"startTime": 0, "endTime": 0}
+//	POST /history/forget                  {"domain": "...", "startTime": 0, "endTime": 0}
+//	GET  /downloads?q=<query>
+//	POST /downloads                       {"url": "...", "filename": "...", "saveAs": false}
+//	GET  /downloads/<id>
+//	POST /downloads/<id>/pause
+//	POST /downloads/<id>/resume
+//	POST /downloads/<id>/cancel
+//	POST /downloads/<id>/retry
+//	POST /downloads/<id>/erase
+//	POST /downloads/<id>/delete-file
+//	POST /open-incognito                  {"url": "..."}
+//	GET  /recent
+//	POST /restore                         {"sessionId": "..."}
+//	POST /open                            {"url": "...", "target": "tab"}
+func (s *httpServer) route(svc *rpcServer, r *http.Request) (interface{}, error) {
+	var (
+		parts = strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		query = r.URL.Query().Get("q")
+	)
+
+	switch {
+	case match(parts, "ping"):
+		var pong string
+		err := get(r, func() error { return svc.Ping("", &pong) })
+		return pong, err
+
+	case match(parts, "extension"):
+		var info ExtensionInfo
+		err := get(r, func() error { return svc.ExtensionInfo("", &info) })
+		return info, err
+
+	case match(parts, "windows"):
+		if r.Method == "POST" {
+			var (
+				arg NewWindowArg
+				win Window
+			)
+			if err := readBody(r, &arg); err != nil {
+				return nil, err
+			}
+			err := svc.NewWindow(arg, &win)
+			return win, err
+		}
+		windows := []Window{}
+		err := get(r, func() error { return svc.Windows("", &windows) })
+		return windows, err
+
+	case match(parts, "containers"):
+		containers := []Container{}
+		err := get(r, func() error { return svc.Containers("", &containers) })
+		return containers, err
+
+	case len(parts) == 3 && parts[0] == "windows":
+		id, err := strconv.Atoi(parts[1])
+		if err != nil || id < 1 {
+			return nil, errHTTP{http.StatusBadRequest, fmt.Sprintf("invalid window ID: %q", parts[1])}
+		}
+		var fn func(int, *struct{}) error
+		switch parts[2] {
+		case "focus":
+			fn = svc.FocusWindow
+		case "minimize":
+			fn = svc.MinimizeWindow
+		case "close":
+			fn = svc.CloseWindow
+		default:
+			return nil, errHTTP{http.StatusNotFound, "not found: " + r.URL.Path}
+		}
+		if err := allow(r, "POST"); err != nil {
+			return nil, err
+		}
+		return nil, fn(id, &struct{}{})
+
+	case match(parts, "tabs"):
+		tabs := []Tab{}
+		err := get(r, func() error { return svc.Tabs("", &tabs) })
+		return tabs, err
+
+	case match(parts, "bookmarks"):
+		if r.Method == "POST" {
+			var (
+				arg CreateBookmarkArg
+				bm  Bookmark
+			)
+			if err := readBody(r, &arg); err != nil {
+				return nil, err
+			}
+			if arg.URL == "" {
+				return nil, errHTTP{http.StatusBadRequest, "url is empty"}
+			}
+			err := svc.CreateBookmark(arg, &bm)
+			return bm, err
+		}
+		bookmarks := []Bookmark{}
+		err := get(r, func() error { return svc.Bookmarks(query, &bookmarks) })
+		return bookmarks, err
+
+	case match(parts, "bookmark-tree"):
+		nodes := []Bookmark{}
+		err := get(r, func() error { return svc.BookmarkTree("", &nodes) })
+		return nodes, err
+
+	case match(parts, "history"):
+		history := []History{}
+		v := r.URL.Query()
+		if v.Get("start") == "" && v.Get("end") == "" && v.Get("max") == "" {
+			err := get(r, func() error { return svc.History(query, &history) })
+			return history, err
+		}
+		var (
+			arg = SearchHistoryArg{Text: query}
+			max int64
+			err error
+		)
+		if arg.StartTime, err = queryInt(v, "start"); err != nil {
+			return nil, err
+		}
+		if arg.EndTime, err = queryInt(v, "end"); err != nil {
+			return nil, err
+		}
+		if max, err = queryInt(v, "max"); err != nil {
+			return nil, err
+		}
+		arg.MaxResults = int(max)
+		err = get(r, func() error { return svc.SearchHistory(arg, &history) })
+		return history, err
+
+	case match(parts, "visits"):
+		v := r.URL.Query()
+		arg := VisitsArg{URL: v.Get("url"), Domain: v.Get("domain")}
+		if arg.URL == "" && arg.Domain == "" {
+			return nil, errHTTP{http.StatusBadRequest, "url or domain is required"}
+		}
+		var err error
+		if arg.StartTime, err = queryInt(v, "start"); err != nil {
+			return nil, err
+		}
+		if arg.EndTime, err = queryInt(v, "end"); err != nil {
+			return nil, err
+		}
+		visits := []Visit{}
+		err = get(r, func() error { return svc.Visits(arg, &visits) })
+		return visits, err
+
+	case len(parts) == 2 && parts[0] == "history":
+		return s.historyAction(svc, r, parts[1])
+
+	case match(parts, "downloads"):
+		if r.Method == "POST" {
+			var (
+				arg DownloadURLArg
+				dl  Download
+			)
+			if err := readBody(r, &arg); err != nil {
+				return nil, err
+			}
+			if arg.URL == "" {
+				return nil, errHTTP{http.StatusBadRequest, "url is empty"}
+			}
+			err := svc.DownloadURL(arg, &dl)
+			return dl, err
+		}
+		downloads := []Download{}
+		err := get(r, func() error { return svc.Downloads(query, &downloads) })
+		return downloads, err
+
+	case len(parts) == 2 && parts[0] == "downloads",
+		len(parts) == 3 && parts[0] == "downloads":
+		id, err := strconv.Atoi(parts[1])
+		if err != nil || id < 1 {
+			return nil, errHTTP{http.StatusBadRequest, fmt.Sprintf("invalid download ID: %q", parts[1])}
+		}
+		if len(parts) == 2 {
+			var dl Download
+			err = get(r, func() error { return svc.Download(id, &dl) })
+			return dl, err
+		}
+		return s.downloadAction(svc, r, id, parts[2])
+
+	case match(parts, "close-tabs"):
+		var arg struct {
+			TabIDs []int `json:"tabIds"`
+		}
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		return nil, svc.CloseTabs(arg.TabIDs, &struct{}{})
+
+	case match(parts, "move-tabs"):
+		arg := MoveTabsArg{Index: -1}
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		return nil, svc.MoveTabs(arg, &struct{}{})
+
+	case match(parts, "open-incognito"):
+		var arg struct {
+			URL string `json:"url"`
+		}
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		if arg.URL == "" {
+			return nil, errHTTP{http.StatusBadRequest, "url is empty"}
+		}
+		return nil, svc.OpenIncognito(arg.URL, &struct{}{})
+
+	case match(parts, "recent"):
+		sessions := []Session{}
+		err := get(r, func() error { return svc.RecentlyClosed(0, &sessions) })
+		return sessions, err
+
+	case match(parts, "restore"):
+		var arg struct {
+			SessionID string `json:"sessionId"`
+		}
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		if arg.SessionID == "" {
+			return nil, errHTTP{http.StatusBadRequest, "sessionId is empty"}
+		}
+		var session Session
+		err := svc.RestoreSession(arg.SessionID, &session)
+		return session, err
+
+	case match(parts, "open"):
+		var arg OpenURLArg
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		if err := arg.validate(); err != nil {
+			return nil, errHTTP{http.StatusBadRequest, err.Error()}
+		}
+		var tab Tab
+		if err := svc.OpenURL(arg, &tab); err != nil {
+			return nil, err
+		}
+		return tab, nil
+
+	case len(parts) == 3 && parts[0] == "bookmarks":
+		return s.bookmarkAction(svc, r, parts[1], parts[2])
+
+	case len(parts) == 2 && parts[0] == "tabs":
+		id, err := parseTabID(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		var tab Tab
+		err = get(r, func() error { return svc.Tab(id, &tab) })
+		return tab, err
+
+	case len(parts) == 3 && parts[0] == "tabs":
+		id, err := parseTabID(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		// actions need a real tab ID, as the extension doesn't
+		// treat 0 as the active tab for them
+		if id == 0 {
+			var tab Tab
+			if err := svc.Tab(0, &tab); err != nil {
+				return nil, err
+			}
+			id = tab.ID
+		}
+		return s.tabAction(svc, r, id, parts[2])
+	}
+
+	return nil, errHTTP{http.StatusNotFound, "not found: " + r.URL.Path}
+}
+
+// bookmarkAction calls the rpcServer method corresponding to a POST to
+// /bookmarks/<id>/<action>.
+func (s *httpServer) bookmarkAction(svc *rpcServer, r *http.Request, id, action string) (interface{}, error) {
+	var bm Bookmark
+	switch action {
+	case "update":
+		arg := UpdateBookmarkArg{}
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		if arg.Title == "" && arg.URL == "" {
+			return nil, errHTTP{http.StatusBadRequest, "title and url are empty"}
+		}
+		arg.ID = id
+		err := svc.UpdateBookmark(arg, &bm)
+		return bm, err
+
+	case "move":
+		arg := MoveBookmarkArg{Index: -1}
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		if arg.ParentID == "" {
+			return nil, errHTTP{http.StatusBadRequest, "parentId is empty"}
+		}
+		arg.ID = id
+		err := svc.MoveBookmark(arg, &bm)
+		return bm, err
+
+	case "delete":
+		if err := allow(r, "POST"); err != nil {
+			return nil, err
+		}
+		return nil, svc.DeleteBookmark(id, &struct{}{})
+	}
+	return nil, errHTTP{http.StatusNotFound, "not found: " + r.URL.Path}
+}
+
+// historyAction calls the rpcServer method corresponding to a POST to
+// /history/<action>.
+func (s *httpServer) historyAction(svc *rpcServer, r *http.Request, action string) (interface{}, error) {
+	switch action {
+	case "delete":
+		var arg struct {
+			URL string `json:"url"`
+		}
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		if arg.URL == "" {
+			return nil, errHTTP{http.StatusBadRequest, "url is empty"}
+		}
+		return nil, svc.DeleteHistoryURL(arg.URL, &struct{}{})
+
+	case "delete-range":
+		var arg DeleteHistoryRangeArg
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		return nil, svc.DeleteHistoryRange(arg, &struct{}{})
+
+	case "forget":
+		var arg ForgetSiteArg
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		if arg.Domain == "" {
+			return nil, errHTTP{http.StatusBadRequest, "domain is empty"}
+		}
+		var res ForgetSiteResult
+		if err := svc.ForgetSite(arg, &res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	return nil, errHTTP{http.StatusNotFound, "not found: " + r.URL.Path}
+}
+
+// downloadAction calls the rpcServer method corresponding to a POST to
+// /downloads/<id>/<action>.
+func (s *httpServer) downloadAction(svc *rpcServer, r *http.Request, id int, action string) (interface{}, error) {
+	var fn func(int, *struct{}) error
+	switch action {
+	case "pause":
+		fn = svc.PauseDownload
+	case "resume":
+		fn = svc.ResumeDownload
+	case "cancel":
+		fn = svc.CancelDownload
+	case "erase":
+		fn = svc.EraseDownload
+	case "delete-file":
+		fn = svc.DeleteDownloadFile
+
+	case "retry":
+		if err := allow(r, "POST"); err != nil {
+			return nil, err
+		}
+		var dl Download
+		err := svc.RetryDownload(id, &dl)
+		return dl, err
+
+	default:
+		return nil, errHTTP{http.StatusNotFound, "not found: " + r.URL.Path}
+	}
+	if err := allow(r, "POST"); err != nil {
+		return nil, err
+	}
+	return nil, fn(id, &struct{}{})
+}
+
+// tabAction calls the rpcServer method corresponding to a POST to
+// /tabs/<id>/<action>.
+func (s *httpServer) tabAction(svc *rpcServer, r *http.Request, id int, action string) (interface{}, error) {
+	var fn func(int, *struct{}) error
+	switch action {
+	case "activate":
+		fn = svc.ActivateTab
+	case "close-left":
+		fn = svc.CloseTabsLeft
+	case "close-right":
+		fn = svc.CloseTabsRight
+	case "close-other":
+		fn = svc.CloseTabsOther
+	case "close":
+		fn = svc.CloseTab
+	case "discard":
+		fn = svc.DiscardTab
+
+	case "duplicate":
+		if err := allow(r, "POST"); err != nil {
+			return nil, err
+		}
+		var tab Tab
+		err := svc.DuplicateTab(id, &tab)
+		return tab, err
+
+	case "reopen":
+		var arg ReopenTabArg
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		arg.TabID = id
+		var tab Tab
+		err := svc.ReopenTabInContainer(arg, &tab)
+		return tab, err
+
+	case "reload":
+		var arg ReloadTabArg
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		arg.TabID = id
+		return nil, svc.ReloadTab(arg, &struct{}{})
+
+	case "pin":
+		arg := PinTabArg{Pinned: true}
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		arg.TabID = id
+		return nil, svc.PinTab(arg, &struct{}{})
+
+	case "mute":
+		arg := MuteTabArg{Muted: true}
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		arg.TabID = id
+		return nil, svc.MuteTab(arg, &struct{}{})
+
+	case "move":
+		var arg MoveTabArg
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		arg.TabID = id
+		return nil, svc.MoveTabToWindow(arg, &struct{}{})
+
+	case "run-js":
+		arg := RunJSArg{TabID: id}
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		arg.TabID = id
+		var js string
+		if err := svc.RunJS(arg, &js); err != nil {
+			return nil, err
+		}
+		// result is already JSON
+		if !json.Valid([]byte(js)) {
+			return js, nil
+		}
+		return json.RawMessage(js), nil
+
+	case "run-bookmarklet":
+		arg := RunBookmarkletArg{TabID: id}
+		if err := readBody(r, &arg); err != nil {
+			return nil, err
+		}
+		arg.TabID = id
+		if arg.BookmarkID == "" {
+			return nil, errHTTP{http.StatusBadRequest, "bookmarkId is empty"}
+		}
+		return nil, svc.RunBookmarklet(arg, &struct{}{})
+
+	default:
+		return nil, errHTTP{http.StatusNotFound, "not found: " + r.URL.Path}
+	}
+
+	if err := allow(r, "POST"); err != nil {
+		return nil, err
+	}
+	return nil, fn(id, &struct{}{})
+}
+
+// writeError sends err to the client as a JSON object with the same code
+// and message as a JSON-RPC error.
+func (s *httpServer) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var (
+		status int
+		e      *rpcError
+	)
+	if he, ok := err.(errHTTP); ok {
+		status = he.Status
+		e = &rpcError{Code: codeInvalidRequest, Message: he.Message}
+		if status == http.StatusNotFound {
+			e.Code = codeMethodNotFound
+		}
+	} else {
+		e = newRPCError(err)
+		switch e.Code {
+		case codeInvalidParams:
+			status = http.StatusBadRequest
+		case codeTimeout:
+			status = http.StatusGatewayTimeout
+		case codeUnsupported:
+			status = http.StatusNotImplemented
+		case codeStopped, codeCancelled:
+			status = http.StatusServiceUnavailable
+		default: // couldn't talk to extension
+			status = http.StatusBadGateway
+		}
+		// extension got the command, but couldn't carry it out
+		if ce, ok := err.(errCommand); ok {
+			status = http.StatusUnprocessableEntity
+			if ce.notFound() {
+				status = http.StatusNotFound
+			}
+		}
+	}
+	log.Printf("[http] [ERROR] %s %s: %v", r.Method, r.URL.Path, e)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error *rpcError `json:"error"`
+	}{e})
+}
+
+// match returns true if path parts are exactly path.
+func match(parts []string, path string) bool {
+	return len(parts) == 1 && parts[0] == path
+}
+
+// allow returns an error if request doesn't use HTTP method.
+func allow(r *http.Request, method string) error {
+	if r.Method != method {
+		return errHTTP{http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed, use %s", r.Method, method)}
+	}
+	return nil
+}
+
+// get calls fn if request is a GET request.
+func get(r *http.Request, fn func() error) error {
+	if err := allow(r, "GET"); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// queryInt parses a non-negative integer URL query parameter. It returns 0
+// if the parameter is empty.
+func queryInt(v url.Values, name string) (int64, error) {
+	s := v.Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errHTTP{http.StatusBadRequest, fmt.Sprintf("invalid %s: %q", name, s)}
+	}
+	return n, nil
+}
+
+// parseTabID parses a tab ID from a URL path. "active" is the active tab.
+func parseTabID(s string) (int, error) {
+	if s == "active" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil || id < 1 {
+		return 0, errHTTP{http.StatusBadRequest, fmt.Sprintf("invalid tab ID: %q", s)}
+	}
+	return id, nil
+}
+
+// readBody unmarshals the JSON body of a POST request into v.
+func readBody(r *http.Request, v interface{}) error {
+	if err := allow(r, "POST"); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBody+1))
+	if err != nil {
+		return errHTTP{http.StatusBadRequest, err.Error()}
+	}
+	if len(data) > maxRequestBody {
+		return errHTTP{http.StatusRequestEntityTooLarge, "request body too large"}
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errHTTP{http.StatusBadRequest, "invalid JSON body: " + err.Error()}
+	}
+	return nil
+}
+
+var _ http.Handler = (*httpServer)(nil)
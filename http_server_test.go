@@ -0,0 +1,42 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteErrorStatus(t *testing.T) {
+	tests := []struct {
+		err error
+		x   int
+	}{
+		{errHTTP{http.StatusMethodNotAllowed, "use POST"}, http.StatusMethodNotAllowed},
+		{errInvalidArg{"empty URL"}, http.StatusBadRequest},
+		{errCommand{"Invalid tab ID: 123"}, http.StatusNotFound},
+		{errCommand{"bookmark not found"}, http.StatusNotFound},
+		{errCommand{"no current tab"}, http.StatusNotFound},
+		{errCommand{"not a bookmarklet"}, http.StatusUnprocessableEntity},
+		{errTimeout{"1.2"}, http.StatusGatewayTimeout},
+		{errUnsupported{Command: "open-url", Version: "1.0"}, http.StatusNotImplemented},
+		{errStopped, http.StatusServiceUnavailable},
+		{errCorruptFrame{"bad chunk"}, http.StatusBadGateway},
+		{errors.New("write |1: broken pipe"), http.StatusBadGateway},
+	}
+
+	s := &httpServer{}
+	for _, td := range tests {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest("POST", "/tabs/123/close", nil)
+		)
+		s.writeError(w, r, td.err)
+		if w.Code != td.x {
+			t.Errorf("%#v: expected status %d, got %d", td.err, td.x, w.Code)
+		}
+	}
+}
@@ -11,6 +11,7 @@ var (
 	iconBookmarklet     = &aw.Icon{Value: "icons/bookmarklet.png"}
 	iconDocs            = &aw.Icon{Value: "icons/docs.png"}
 	iconError           = &aw.Icon{Value: "icons/error.png"}
+	iconFolder          = &aw.Icon{Value: "public.folder", Type: aw.IconTypeFileType}
 	iconHistory         = &aw.Icon{Value: "icons/history.png"}
 	iconIncognito       = &aw.Icon{Value: "icons/incognito.png"}
 	iconInstall         = &aw.Icon{Value: "icons/install.png"}
@@ -0,0 +1,305 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sync"
+)
+
+// JSON-RPC 2.0 error codes. Codes from -32000 to -32099 are
+// specific to this server. See doc/rpc.md.
+const (
+	codeParseError     = -32700 // request isn't valid JSON
+	codeInvalidRequest = -32600 // request isn't a valid JSON-RPC 2.0 request
+	codeMethodNotFound = -32601 // no such method
+	codeInvalidParams  = -32602 // params don't match method's argument
+	codeInternalError  = -32603 // server error
+
+	codeCommandFailed = -32000 // extension returned an error
+	codeTimeout       = -32001 // extension didn't respond in time
+	codeUnsupported   = -32002 // installed extension doesn't support command
+	codeStopped       = -32003 // server is shutting down
+	codeCancelled     = -32004 // call cancelled because client disconnected
+)
+
+// rpcRequest is a JSON-RPC 2.0 request. ID is empty for notifications.
+type rpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// rpcResponse is a JSON-RPC 2.0 response. Exactly one of Result and
+// Error is set.
+type rpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcError is a JSON-RPC 2.0 error object.
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (err *rpcError) Error() string {
+	return fmt.Sprintf("%s (%d)", err.Message, err.Code)
+}
+
+// newRPCError converts an error returned by an rpcServer method to a
+// JSON-RPC error with an appropriate code.
+func newRPCError(err error) *rpcError {
+	code := codeCommandFailed
+	switch err.(type) {
+	case errTimeout:
+		code = codeTimeout
+	case errUnsupported:
+		code = codeUnsupported
+	case errCorruptFrame:
+		code = codeInternalError
+	case errInvalidArg:
+		code = codeInvalidParams
+	}
+	switch err {
+	case errStopped:
+		code = codeStopped
+	case context.Canceled:
+		code = codeCancelled
+	}
+	return &rpcError{Code: code, Message: err.Error()}
+}
+
+// rpcMethod is a method of rpcServer callable via JSON-RPC. Like net/rpc,
+// methods must have the form:
+//
+//	func (s *rpcServer) Name(arg T, reply *R) error
+type rpcMethod struct {
+	fn        reflect.Value // method function; receiver is first argument
+	argType   reflect.Type
+	replyType reflect.Type // type reply points to
+}
+
+// rpcMethods are the methods exposed via JSON-RPC, keyed by "Firefox.<Name>".
+var rpcMethods = registerMethods("Firefox", reflect.TypeOf((*rpcServer)(nil)))
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+// registerMethods returns the exported methods of typ that have the form
+// required by rpcMethod. Method names are prefixed with "<name>.".
+func registerMethods(name string, typ reflect.Type) map[string]rpcMethod {
+	methods := map[string]rpcMethod{}
+	for i := 0; i < typ.NumMethod(); i++ {
+		m := typ.Method(i)
+		t := m.Type
+		if m.PkgPath != "" || t.NumIn() != 3 || t.NumOut() != 1 {
+			continue
+		}
+		if t.In(2).Kind() != reflect.Ptr || t.Out(0) != typeOfError {
+			continue
+		}
+		methods[name+"."+m.Name] = rpcMethod{
+			fn:        m.Func,
+			argType:   t.In(1),
+			replyType: t.In(2).Elem(),
+		}
+	}
+	return methods
+}
+
+// call method m on receiver s with JSON-RPC params.
+func (m rpcMethod) call(s *rpcServer, params json.RawMessage) (json.RawMessage, *rpcError) {
+	argv := reflect.New(m.argType)
+	if err := decodeParams(params, argv.Interface()); err != nil {
+		return nil, &rpcError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	replyv := reflect.New(m.replyType)
+
+	out := m.fn.Call([]reflect.Value{reflect.ValueOf(s), argv.Elem(), replyv})
+	if err, _ := out[0].Interface().(error); err != nil {
+		return nil, newRPCError(err)
+	}
+
+	// methods without a result have reply type struct{}
+	if m.replyType.Kind() == reflect.Struct && m.replyType.NumField() == 0 {
+		return json.RawMessage("null"), nil
+	}
+	js, err := json.Marshal(replyv.Interface())
+	if err != nil {
+		return nil, &rpcError{Code: codeInternalError, Message: err.Error()}
+	}
+	return js, nil
+}
+
+// decodeParams unmarshals JSON-RPC params into v. As each method takes a single
+// argument, params may be given by position as a one-element array, by name
+// as an object (for methods whose argument is a struct), or omitted, in which
+// case the argument is its zero value. For convenience, a bare value such as
+// a string or number is also accepted.
+func decodeParams(params json.RawMessage, v interface{}) error {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		return nil
+	}
+	if params[0] == '[' {
+		var a []json.RawMessage
+		if err := json.Unmarshal(params, &a); err != nil {
+			return err
+		}
+		switch len(a) {
+		case 0:
+			return nil
+		case 1:
+			return json.Unmarshal(a[0], v)
+		default:
+			return fmt.Errorf("method takes 1 parameter, not %d", len(a))
+		}
+	}
+	return json.Unmarshal(params, v)
+}
+
+// handle a single JSON-RPC request. Returns nil if request is a notification.
+func (s *rpcServer) handle(data json.RawMessage) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return &rpcResponse{
+			Version: "2.0",
+			Error:   &rpcError{Code: codeInvalidRequest, Message: err.Error()},
+			ID:      json.RawMessage("null"),
+		}
+	}
+
+	resp := &rpcResponse{Version: "2.0", ID: json.RawMessage("null")}
+	if len(req.ID) > 0 {
+		resp.ID = req.ID
+	}
+
+	if req.Version != "2.0" || req.Method == "" {
+		resp.Error = &rpcError{Code: codeInvalidRequest, Message: `request must have "jsonrpc": "2.0" and a method`}
+		return resp
+	}
+
+	m, ok := rpcMethods[req.Method]
+	if !ok {
+		resp.Error = &rpcError{Code: codeMethodNotFound, Message: fmt.Sprintf("unknown method %q", req.Method)}
+	} else {
+		resp.Result, resp.Error = m.call(s, req.Params)
+	}
+	if resp.Error != nil {
+		log.Printf("[ERROR] %s: %v", req.Method, resp.Error)
+	}
+
+	if len(req.ID) == 0 { // notification
+		return nil
+	}
+	return resp
+}
+
+// handleBatch handles a batch of requests concurrently. Returns nil if
+// the batch contains only notifications.
+func (s *rpcServer) handleBatch(data json.RawMessage) interface{} {
+	var batch []json.RawMessage
+	if err := json.Unmarshal(data, &batch); err != nil || len(batch) == 0 {
+		return &rpcResponse{
+			Version: "2.0",
+			Error:   &rpcError{Code: codeInvalidRequest, Message: "invalid or empty batch"},
+			ID:      json.RawMessage("null"),
+		}
+	}
+
+	var (
+		wg        sync.WaitGroup
+		responses = make([]*rpcResponse, len(batch))
+	)
+	for i, req := range batch {
+		wg.Add(1)
+		go func(i int, req json.RawMessage) {
+			defer wg.Done()
+			responses[i] = s.handle(req)
+		}(i, req)
+	}
+	wg.Wait()
+
+	var results []*rpcResponse
+	for _, r := range responses {
+		if r != nil {
+			results = append(results, r)
+		}
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	return results
+}
+
+// serve JSON-RPC requests from a single client. Requests are JSON values
+// (typically one per line) and are handled concurrently, so responses may
+// be sent in a different order. Outstanding calls are cancelled when the
+// client disconnects.
+func (s *rpcServer) serveConn(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer conn.Close()
+
+	var (
+		svc = &rpcServer{ff: s.ff, ctx: ctx}
+		dec = json.NewDecoder(conn)
+		enc = json.NewEncoder(conn)
+		mu  sync.Mutex // protects enc
+		wg  sync.WaitGroup
+	)
+	send := func(v interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(v); err != nil {
+			log.Printf("[ERROR] send JSON-RPC response: %v", err)
+		}
+	}
+
+	for {
+		var data json.RawMessage
+		if err := dec.Decode(&data); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				// decoder can't recover from invalid JSON, so finish
+				// outstanding calls and close the connection
+				send(&rpcResponse{
+					Version: "2.0",
+					Error:   &rpcError{Code: codeParseError, Message: err.Error()},
+					ID:      json.RawMessage("null"),
+				})
+				wg.Wait()
+				return
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var resp interface{}
+			if data[0] == '[' {
+				resp = svc.handleBatch(data)
+			} else if r := svc.handle(data); r != nil {
+				resp = r
+			}
+			if resp != nil {
+				send(resp)
+			}
+		}()
+	}
+
+	// client has disconnected, so abandon its outstanding calls
+	cancel()
+	wg.Wait()
+}
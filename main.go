@@ -64,14 +64,23 @@ var (
 	socketPath string
 	pidFile    string
 	logfile    string
+	textErrors bool // set by useTextErrors
 
 	// CLI flags/environment variables
-	URL        string
-	urlDefault string
-	tabID      int
-	action     string
-	bookmarkID string
-	query      string
+	URL         string
+	urlDefault  string
+	tabID       int
+	windowID    int
+	picker      string
+	containerID string
+	sessionID   string
+	folderID    string
+	title       string
+	profileDir  string
+	action      string
+	bookmarkID  string
+	downloadID  int
+	query       string
 
 	rootFlags = flag.NewFlagSet("alfred-firefox", flag.ExitOnError)
 	rootCmd   = &ffcli.Command{
@@ -97,20 +106,39 @@ func init() {
 	rootFlags.StringVar(&urlDefault, "url-default", "Open in Default Application",
 		"Default URL action")
 	rootFlags.IntVar(&tabID, "tab", 0, "ID of tab")
+	rootFlags.IntVar(&windowID, "window", 0, "ID of window")
 	rootFlags.StringVar(&bookmarkID, "bookmark", "", "ID of bookmark")
+	rootFlags.IntVar(&downloadID, "download", 0, "ID of download")
 	rootFlags.StringVar(&query, "query", "", "search query")
 	rootFlags.StringVar(&action, "action", "", "action name")
+	rootFlags.StringVar(&picker, "picker", "", "list to choose action target from")
+	rootFlags.StringVar(&containerID, "container", "", "ID of container (cookie store)")
+	rootFlags.StringVar(&sessionID, "session", "", "ID of closed tab or window")
+	rootFlags.StringVar(&folderID, "folder", "", "ID of bookmark folder")
+	rootFlags.StringVar(&title, "title", "", "title of bookmark or tab")
+	rootFlags.StringVar(&profileDir, "firefox-profile", "", "Firefox profile directory to read bookmark tags from")
 
 	rootCmd.Subcommands = []*ffcli.Command{
 		actionsCmd,
+		bookmarkCmd,
 		bookmarkletsCmd,
 		bookmarksCmd,
+		browseBookmarksCmd,
+		containerCmd,
+		containersCmd,
 		currentTabCmd,
 		currentTabInfoCmd,
+		dedupeTabsCmd,
+		downloadCmd,
 		downloadsCmd,
+		exportCmd,
+		faviconsCmd,
+		forgetCmd,
 		historyCmd,
 		injectCmd,
 		openCmd,
+		recentCmd,
+		restoreCmd,
 		revealCmd,
 		runBookmarkletCmd,
 		serveCmd,
@@ -118,7 +146,11 @@ func init() {
 		tabCmd,
 		tabsCmd,
 		urlCmd,
+		visitsCmd,
 		updateCmd,
+		watchCmd,
+		windowCmd,
+		windowsCmd,
 	}
 	pidFile = filepath.Join(wf.CacheDir(), "server.pid")
 	logfile = filepath.Join(wf.CacheDir(), fmt.Sprintf("%s.server.log", wf.BundleID()))
@@ -142,10 +174,20 @@ func run() {
 	}
 
 	if err := rootCmd.Run(wf.Args()); err != nil {
+		if !textErrors && showClientError(err) {
+			return
+		}
 		panic(err)
 	}
 }
 
+// useTextErrors tells the workflow to show errors as text, not as Alfred
+// JSON. It's called by commands that aren't Script Filters.
+func useTextErrors() {
+	textErrors = true
+	wf.Configure(aw.TextErrors(true))
+}
+
 func main() { wf.Run(run) }
 
 // Magic Action to install native application manifest in Firefox
@@ -4,40 +4,109 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 )
 
-/*
+// Window represents a Firefox window. It contains a subset of the properties
+// of the windows.Window object from Firefox's extensions API.
+// https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/API/windows/Window
 type Window struct {
-	ID     int    `json:"id"`
-	Title  string `json:"title"`
-	Active bool   `json:"active"`
-	Tabs   []Tab  `json:"tabs"`
+	ID        int    `json:"id"`        // unique ID of window
+	Title     string `json:"title"`     // title of window's active tab
+	Focused   bool   `json:"focused"`   // whether window is the frontmost window
+	Incognito bool   `json:"incognito"` // whether window is a private window
+	State     string `json:"state"`     // "normal", "minimized", "maximized" or "fullscreen"
+	Tabs      []Tab  `json:"tabs"`      // window's tabs in order
 }
 
 func (w Window) String() string {
-	return fmt.Sprintf("Window(id=%d, title=%q, active=%v)", w.ID, w.Title, w.Active)
+	return fmt.Sprintf("Window(id=%d, title=%q, focused=%v, tabs=%d)", w.ID, w.Title, w.Focused, len(w.Tabs))
+}
+
+// ActiveTab returns the window's active tab. ok is false if the window
+// has no tabs.
+func (w Window) ActiveTab() (tab Tab, ok bool) {
+	for _, t := range w.Tabs {
+		if t.Active {
+			return t, true
+		}
+	}
+	return Tab{}, false
 }
-*/
 
 // Tab represents a Firefox tab. It contains a subset of the properties
 // of the tab.Tab object from Firefox's extensions API.
 // https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/API/tabs/Tab
 type Tab struct {
-	ID       int    `json:"id"`       // unique ID of tab
-	WindowID int    `json:"windowId"` // unique ID of window tab belongs to
-	Index    int    `json:"index"`    // position of tab in window
-	Title    string `json:"title"`    // tab's title
-	URL      string `json:"url"`      // tab's URL
-	Active   bool   `json:"active"`   // whether tab is the active tab in its window
+	ID            int    `json:"id"`            // unique ID of tab
+	WindowID      int    `json:"windowId"`      // unique ID of window tab belongs to
+	Index         int    `json:"index"`         // position of tab in window
+	Title         string `json:"title"`         // tab's title
+	URL           string `json:"url"`           // tab's URL
+	Active        bool   `json:"active"`        // whether tab is the active tab in its window
+	Pinned        bool   `json:"pinned"`        // whether tab is pinned
+	Audible       bool   `json:"audible"`       // whether tab is producing sound
+	Muted         bool   `json:"muted"`         // whether tab is muted (mutedInfo.muted)
+	Discarded     bool   `json:"discarded"`     // whether tab's content has been unloaded
+	Incognito     bool   `json:"incognito"`     // whether tab is in a private window
+	LastAccessed  int64  `json:"lastAccessed"`  // when tab was last active (ms since epoch)
+	FaviconURL    string `json:"favIconUrl"`    // URL of tab's favicon; may be a data: URL
+	CookieStoreID string `json:"cookieStoreId"` // ID of tab's cookie store/container
 }
 
 func (t Tab) String() string {
 	return fmt.Sprintf("Tab(id=%d, title=%q, url=%q, active=%v)", t.ID, t.Title, t.URL, t.Active)
 }
 
+// LastUsed returns the time the tab was last active.
+func (t Tab) LastUsed() time.Time {
+	return time.Unix(0, t.LastAccessed*int64(time.Millisecond))
+}
+
+// Session is a recently-closed tab or window. Exactly one of Tab and Window
+// is set. It contains a subset of the properties of the sessions.Session object.
+// https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/API/sessions/Session
+type Session struct {
+	ID           string  `json:"sessionId"`    // ID to restore tab or window with
+	LastModified int64   `json:"lastModified"` // when tab or window was closed (ms since epoch)
+	Tab          *Tab    `json:"tab"`          // closed tab
+	Window       *Window `json:"window"`       // closed window
+}
+
+func (s Session) String() string {
+	if s.Tab != nil {
+		return fmt.Sprintf("Session(id=%q, tab=%v)", s.ID, s.Tab)
+	}
+	return fmt.Sprintf("Session(id=%q, window=%v)", s.ID, s.Window)
+}
+
+// Closed returns the time the tab or window was closed.
+func (s Session) Closed() time.Time {
+	return time.Unix(0, s.LastModified*int64(time.Millisecond))
+}
+
+// ID of the cookie store of tabs that aren't in a container.
+const defaultContainer = "firefox-default"
+
+// Container is a Firefox container (contextual identity). It contains a subset
+// of the properties of the contextualIdentities.ContextualIdentity object.
+// https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/API/contextualIdentities/ContextualIdentity
+type Container struct {
+	ID        string `json:"cookieStoreId"` // ID of container's cookie store; matches Tab.CookieStoreID
+	Name      string `json:"name"`          // container name
+	Color     string `json:"color"`         // colour name, e.g. "blue" or "turquoise"
+	ColorCode string `json:"colorCode"`     // colour as hex code, e.g. "#37adff"
+	Icon      string `json:"icon"`          // icon name, e.g. "fingerprint"
+}
+
+func (c Container) String() string {
+	return fmt.Sprintf("Container(id=%q, name=%q, color=%q)", c.ID, c.Name, c.Color)
+}
+
 // Bookmark represents a Firefox bookmark. It contains a subset of the properties
 // of the bookmarks.BookmarkTreeNode object from the extensions API.
 // https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/API/bookmarks/BookmarkTreeNode
@@ -48,6 +117,11 @@ type Bookmark struct {
 	URL      string `json:"url"`      // only present for type "bookmark"
 	ParentID string `json:"parentId"` // ID of folder bookmark belongs to
 	Index    int    `json:"index"`    // position in containing folder
+	Path     string `json:"path"`     // path of containing folder, e.g. "Bookmarks Toolbar/Go"
+
+	// read from places database by workflow; not set by extension
+	Tags    []string `json:"tags,omitempty"`
+	Keyword string   `json:"keyword,omitempty"`
 }
 
 func (bm Bookmark) String() string {
@@ -74,28 +148,93 @@ func (bm Bookmark) JavaScript() string {
 // of a native history.HistoryItem object.
 // https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/API/history/HistoryItem
 type History struct {
-	ID    string `json:"id"`    // unique ID
-	Title string `json:"title"` // page title
-	URL   string `json:"url"`   // page URL
+	ID            string `json:"id"`            // unique ID
+	Title         string `json:"title"`         // page title
+	URL           string `json:"url"`           // page URL
+	VisitCount    int    `json:"visitCount"`    // number of times page was visited
+	TypedCount    int    `json:"typedCount"`    // number of times URL was typed into address bar
+	LastVisitTime int64  `json:"lastVisitTime"` // when page was last visited (ms since epoch)
 }
 
 func (h History) String() string {
 	return fmt.Sprintf("History(id=%q, title=%q, url=%q)", h.ID, h.Title, h.URL)
 }
 
+// LastVisit returns the time the page was last visited.
+func (h History) LastVisit() time.Time {
+	return time.Unix(0, h.LastVisitTime*int64(time.Millisecond))
+}
+
+// Visit is a visit to a page in the browser history. It contains the
+// properties of a native history.VisitItem object, plus the page's URL and
+// title.
+// https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/API/history/VisitItem
+type Visit struct {
+	ID               string `json:"visitId"`          // unique ID
+	HistoryID        string `json:"id"`               // ID of History entry for page
+	URL              string `json:"url"`              // page URL
+	Title            string `json:"title"`            // page title; set by workflow, not extension
+	VisitTime        int64  `json:"visitTime"`        // when page was visited (ms since epoch)
+	ReferringVisitID string `json:"referringVisitId"` // visit the user came from
+	Transition       string `json:"transition"`       // how user got to page, e.g. "link" or "typed"
+}
+
+func (v Visit) String() string {
+	return fmt.Sprintf("Visit(id=%q, url=%q, transition=%q)", v.ID, v.URL, v.Transition)
+}
+
+// Time returns the time of the visit.
+func (v Visit) Time() time.Time {
+	return time.Unix(0, v.VisitTime*int64(time.Millisecond))
+}
+
 // Download is a file downloaded by Firefox. Contains a subset of the properties
 // of a Firefox downloads.DownloadItem object.
 // https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/API/downloads/DownloadItem
 type Download struct {
-	ID       int    `json:"id"`     // unique ID
-	Path     string `json:"path"`   // absolute filepath to downloaded file
-	Size     int64  `json:"size"`   // size of file in bytes
-	URL      string `json:"url"`    // URL file was downloaded from
-	MimeType string `json:"mime"`   // mime type of file
-	Exists   bool   `json:"exists"` // whether Path still exists on disk
-	Err      string `json:"error"`  // error message
+	ID            int    `json:"id"`            // unique ID
+	Path          string `json:"path"`          // absolute filepath to downloaded file
+	Size          int64  `json:"size"`          // size of file in bytes
+	URL           string `json:"url"`           // URL file was downloaded from
+	MimeType      string `json:"mime"`          // mime type of file
+	Exists        bool   `json:"exists"`        // whether Path still exists on disk
+	Err           string `json:"error"`         // error message
+	State         string `json:"state"`         // "in_progress", "interrupted" or "complete"
+	Paused        bool   `json:"paused"`        // whether download is paused
+	CanResume     bool   `json:"canResume"`     // whether paused or interrupted download can be resumed
+	BytesReceived int64  `json:"bytesReceived"` // number of bytes downloaded so far
+	TotalBytes    int64  `json:"totalBytes"`    // size of download; -1 if unknown
+	StartTime     int64  `json:"startTime"`     // when download started (ms since epoch)
+	EndTime       int64  `json:"endTime"`       // when download finished (ms since epoch); 0 if it hasn't
+	Danger        string `json:"danger"`        // "safe", "accepted" or the reason download may be dangerous
 }
 
 func (d Download) String() string {
-	return fmt.Sprintf("Download(id=%q, path=%q, url=%q)", d.ID, d.Path, d.URL)
+	return fmt.Sprintf("Download(id=%d, path=%q, url=%q)", d.ID, d.Path, d.URL)
+}
+
+// States of a download.
+const (
+	downloadInProgress  = "in_progress"
+	downloadInterrupted = "interrupted"
+	downloadComplete    = "complete"
+)
+
+// Dangerous returns true if the browser considers the download dangerous
+// and the user hasn't accepted it.
+func (d Download) Dangerous() bool {
+	return d.Danger != "" && d.Danger != "safe" && d.Danger != "accepted"
+}
+
+// Event is a message pushed by the extension when something happens in the
+// browser, e.g. "tab-created" or "download-finished". The contents of Data
+// depend on the type of event.
+type Event struct {
+	Name string          `json:"event"`   // type of event
+	Time time.Time       `json:"time"`    // when the event was received
+	Data json.RawMessage `json:"payload"` // event-specific data
+}
+
+func (ev Event) String() string {
+	return fmt.Sprintf("Event(name=%q, time=%s)", ev.Name, ev.Time.Format(time.RFC3339))
 }
@@ -0,0 +1,193 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/deanishe/awgo/util"
+)
+
+const (
+	placesCacheName = "places-meta.json" // tags & keywords read from places database
+	placesDBName    = "places.sqlite"
+	sqliteCmd       = "/usr/bin/sqlite3"
+)
+
+// directory containing Firefox profiles
+var profilesDir = os.ExpandEnv("${HOME}/Library/Application Support/Firefox/Profiles")
+
+// Bookmark tags and keywords aren't available via the WebExtension API, so
+// they're read directly from the places database in the Firefox profile.
+// Firefox keeps the database locked, so it's copied to the cache directory
+// first, and the results are cached until the database changes.
+//
+// In the database, each tag is a folder in the "tags" root folder, and
+// tagging a bookmark adds a second bookmark with the same place (fk) to the
+// tag's folder. Keywords are stored per-place in moz_keywords. Bookmark
+// GUIDs are the IDs used by the WebExtension API. Tags are separated by
+// 0x1D, as they may contain commas.
+const placesSQL = `
+SELECT b.guid,
+	IFNULL((SELECT group_concat(t.title, char(29))
+		FROM moz_bookmarks tb JOIN moz_bookmarks t ON t.id = tb.parent
+		WHERE tb.fk = b.fk AND t.parent = r.id), ''),
+	IFNULL((SELECT keyword FROM moz_keywords WHERE place_id = b.fk LIMIT 1), '')
+FROM moz_bookmarks b, (SELECT id FROM moz_bookmarks WHERE guid = 'tags________') r
+WHERE b.type = 1
+	AND b.parent NOT IN (SELECT id FROM moz_bookmarks WHERE parent = r.id);
+`
+
+// placesMeta is the tags and keyword of a bookmark.
+type placesMeta struct {
+	Tags    []string `json:"tags"`
+	Keyword string   `json:"keyword"`
+}
+
+// placesDB returns the path of the places database. If -firefox-profile
+// isn't set, the most recently modified database in any profile is used.
+func placesDB() (string, error) {
+	if profileDir != "" {
+		p := filepath.Join(profileDir, placesDBName)
+		if !util.PathExists(p) {
+			return "", fmt.Errorf("no places database in profile %q", profileDir)
+		}
+		return p, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(profilesDir, "*", placesDBName))
+	if err != nil {
+		return "", err
+	}
+	var (
+		newest string
+		mod    time.Time
+	)
+	for _, p := range paths {
+		if t := placesModTime(p); t.After(mod) {
+			newest, mod = p, t
+		}
+	}
+	if newest == "" {
+		return "", errors.New("no Firefox profile found")
+	}
+	return newest, nil
+}
+
+// placesModTime returns when the database at path was last changed, which
+// includes its write-ahead log.
+func placesModTime(path string) time.Time {
+	var mod time.Time
+	for _, p := range []string{path, path + "-wal"} {
+		if fi, err := os.Stat(p); err == nil && fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	return mod
+}
+
+// loadPlacesMeta returns the tags and keywords of all bookmarks, keyed by
+// bookmark ID.
+func loadPlacesMeta() (map[string]placesMeta, error) {
+	db, err := placesDB()
+	if err != nil {
+		return nil, err
+	}
+
+	meta := map[string]placesMeta{}
+	if age, err := wf.Cache.Age(placesCacheName); err == nil && age < time.Since(placesModTime(db)) {
+		if err := wf.Cache.LoadJSON(placesCacheName, &meta); err == nil {
+			return meta, nil
+		}
+		log.Printf("[ERROR] load tags & keywords: %v", err)
+	}
+
+	defer util.Timed(time.Now(), "read tags & keywords")
+	if meta, err = readPlacesMeta(db); err != nil {
+		return nil, err
+	}
+	if err := wf.Cache.StoreJSON(placesCacheName, meta); err != nil {
+		log.Printf("[ERROR] cache tags & keywords: %v", err)
+	}
+	return meta, nil
+}
+
+// readPlacesMeta reads bookmark tags and keywords from a copy of database db.
+// Each run uses its own copy, as Alfred may run several at once.
+func readPlacesMeta(db string) (map[string]placesMeta, error) {
+	dir, err := ioutil.TempDir(wf.CacheDir(), "places-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	dbCopy := filepath.Join(dir, placesDBName)
+	for _, suffix := range []string{"", "-wal"} {
+		if err := copyFile(db+suffix, dbCopy+suffix); err != nil {
+			if suffix != "" && os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(sqliteCmd, "-ascii", dbCopy, placesSQL)
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("query places database: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parsePlacesMeta(data), nil
+}
+
+// parsePlacesMeta parses the output of placesSQL in sqlite3's ASCII mode,
+// where columns are separated by 0x1F and rows by 0x1E. Bookmarks without
+// tags or a keyword are ignored.
+func parsePlacesMeta(data []byte) map[string]placesMeta {
+	meta := map[string]placesMeta{}
+	for _, row := range strings.Split(string(data), "\x1e") {
+		cols := strings.Split(row, "\x1f")
+		if len(cols) != 3 || (cols[1] == "" && cols[2] == "") {
+			continue
+		}
+		m := placesMeta{Keyword: cols[2]}
+		if cols[1] != "" {
+			m.Tags = strings.Split(cols[1], "\x1d")
+			sort.Strings(m.Tags)
+		}
+		meta[cols[0]] = m
+	}
+	return meta
+}
+
+// copyFile copies file src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
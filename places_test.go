@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// placesRows returns rows in sqlite3's ASCII output format.
+func placesRows(rows ...[]string) []byte {
+	var s string
+	for _, cols := range rows {
+		s += strings.Join(cols, "\x1f") + "\x1e"
+	}
+	return []byte(s)
+}
+
+func TestParsePlacesMeta(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		x    map[string]placesMeta
+	}{
+		{"empty", nil, map[string]placesMeta{}},
+		{
+			"tags and keyword",
+			placesRows([]string{"guid1", "work\x1ddocs", "wd"}),
+			map[string]placesMeta{"guid1": {Tags: []string{"docs", "work"}, Keyword: "wd"}},
+		},
+		{
+			"tags only",
+			placesRows([]string{"guid1", "news", ""}),
+			map[string]placesMeta{"guid1": {Tags: []string{"news"}}},
+		},
+		{
+			"keyword only",
+			placesRows([]string{"guid1", "", "gh"}),
+			map[string]placesMeta{"guid1": {Keyword: "gh"}},
+		},
+		{
+			"no tags or keyword",
+			placesRows([]string{"guid1", "", ""}, []string{"guid2", "", "kw"}),
+			map[string]placesMeta{"guid2": {Keyword: "kw"}},
+		},
+		{
+			"separators in tags and keyword",
+			placesRows([]string{"guid1", "a,b\x1dc d\x1dx;y", "k,w"}),
+			map[string]placesMeta{"guid1": {Tags: []string{"a,b", "c d", "x;y"}, Keyword: "k,w"}},
+		},
+		{
+			"newlines in tags",
+			placesRows(
+				[]string{"guid1", "line\none", ""},
+				[]string{"guid2", "", "kw"},
+			),
+			map[string]placesMeta{
+				"guid1": {Tags: []string{"line\none"}},
+				"guid2": {Keyword: "kw"},
+			},
+		},
+		{
+			"malformed row",
+			placesRows([]string{"guid1", "tag"}, []string{"guid2", "tag", ""}),
+			map[string]placesMeta{"guid2": {Tags: []string{"tag"}}},
+		},
+	}
+
+	for _, td := range tests {
+		td := td
+		t.Run(td.name, func(t *testing.T) {
+			v := parsePlacesMeta(td.in)
+			if !reflect.DeepEqual(v, td.x) {
+				t.Errorf("expected=%#v, got=%#v", td.x, v)
+			}
+		})
+	}
+}
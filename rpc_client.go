@@ -4,132 +4,608 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
-	"net/rpc"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/deanishe/awgo/util"
+)
+
+// How long the client keeps trying to reach the server. The server is
+// restarted whenever Firefox reconnects to the workflow, so it may be
+// briefly unavailable.
+const (
+	retryWindow = time.Second * 3        // if server is (re)starting
+	retryQuick  = time.Millisecond * 300 // if no server is running
+	retryDelay  = time.Millisecond * 50  // initial delay between attempts
 )
 
-// RPC client used by workflow to execute extension actions.
+// RPC methods that are safe to call again if the connection fails.
+var idempotent = map[string]bool{
+	"Firefox.AppName":        true,
+	"Firefox.Ping":           true,
+	"Firefox.ExtensionInfo":  true,
+	"Firefox.Windows":        true,
+	"Firefox.Tabs":           true,
+	"Firefox.Tab":            true,
+	"Firefox.Containers":     true,
+	"Firefox.RecentlyClosed": true,
+	"Firefox.Bookmarks":      true,
+	"Firefox.BookmarkTree":   true,
+	"Firefox.History":        true,
+	"Firefox.SearchHistory":  true,
+	"Firefox.Visits":         true,
+	"Firefox.Downloads":      true,
+	"Firefox.Download":       true,
+}
+
+// errNotRunning is returned if the client can't connect to the server,
+// typically because Firefox isn't running or the extension isn't installed.
+type errNotRunning struct {
+	Err error
+}
+
+func (err errNotRunning) Error() string {
+	return fmt.Sprintf("can't connect to browser (is Firefox running with the extension enabled?): %v", err.Err)
+}
+
+// errConnectionLost is returned if the connection to the server failed
+// during a call. The command may or may not have run.
+type errConnectionLost struct {
+	Method string
+	Err    error
+}
+
+func (err errConnectionLost) Error() string {
+	return fmt.Sprintf("lost connection to browser during %s (it may have run): %v", err.Method, err.Err)
+}
+
+// errNoResponse is returned if the server is running, but the extension
+// didn't respond to a command.
+type errNoResponse struct {
+	Method string
+	Err    error
+}
+
+func (err errNoResponse) Error() string {
+	return fmt.Sprintf("browser extension didn't respond to %s: %v", err.Method, err.Err)
+}
+
+// errCommandFailed is returned if the browser returned an error.
+type errCommandFailed struct {
+	Method string
+	Err    *rpcError
+}
+
+func (err errCommandFailed) Error() string {
+	return fmt.Sprintf("%s failed: %s", err.Method, err.Err.Message)
+}
+
+// RPC client used by workflow to execute extension actions. It connects
+// to the server when first called and reconnects if the connection fails.
+// Methods return errNotRunning, errConnectionLost, errNoResponse or
+// errCommandFailed.
 type rpcClient struct {
-	client  *rpc.Client
+	client  *jsonrpcClient
 	appName string
 }
 
 // Create new RPC client. Returns an error if connection to server fails.
 func newClient() (*rpcClient, error) {
-	c, err := rpc.Dial("unix", socketPath)
-	if err != nil {
-		return nil, err
-	}
-	client := &rpcClient{client: c}
-	client.appName, err = client.AppName()
-	if err != nil {
+	client := &rpcClient{}
+	if err := client.connect(); err != nil {
 		return nil, err
 	}
-	log.Printf("RPC client connected to %q", client.appName)
 	return client, nil
 }
 
-// return new RPC client, panicking if it can't connect to server
+// return new RPC client. The client connects when first called, so
+// errors are returned by its methods.
 func mustClient() *rpcClient {
-	c, err := newClient()
-	if err != nil {
-		log.Printf("[ERROR] %v", err)
-		panic("Cannot Connect to Extension")
+	return &rpcClient{}
+}
+
+// connect to server, retrying if it's (re)starting.
+func (c *rpcClient) connect() error {
+	if c.client != nil {
+		return nil
+	}
+
+	var (
+		window = retryQuick
+		delay  = retryDelay
+		start  = time.Now()
+	)
+	if serverRunning() {
+		window = retryWindow
+	}
+	for {
+		jc, err := dialJSONRPC(socketPath)
+		if err == nil {
+			if err = jc.Call("Firefox.AppName", "", &c.appName); err == nil {
+				c.client = jc
+				log.Printf("RPC client connected to %q", c.appName)
+				return nil
+			}
+			jc.Close()
+		}
+		if time.Since(start)+delay > window {
+			return errNotRunning{err}
+		}
+		log.Printf("[WARNING] connect to server: %v (retrying in %v)", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// call RPC method, reconnecting and retrying idempotent methods if the
+// connection fails or the server is shutting down.
+func (c *rpcClient) call(method string, arg, reply interface{}) error {
+	var (
+		delay = retryDelay
+		start = time.Now()
+	)
+	for {
+		if err := c.connect(); err != nil {
+			return err
+		}
+		err := c.client.Call(method, arg, reply)
+		if err == nil {
+			return nil
+		}
+
+		retry := false
+		switch e := err.(type) {
+		case *rpcError:
+			switch e.Code {
+			case codeStopped:
+				retry = true
+				err = errNoResponse{method, e}
+			case codeTimeout:
+				err = errNoResponse{method, e}
+			default:
+				err = errCommandFailed{method, e}
+			}
+		case connError: // connection failed after command was sent
+			retry = true
+			c.client.Close()
+			c.client = nil
+			err = errConnectionLost{method, e.Err}
+		default: // couldn't encode params or decode result
+			return err
+		}
+
+		if !retry || !idempotent[method] || time.Since(start)+delay > retryWindow {
+			return err
+		}
+		log.Printf("[WARNING] %v (retrying in %v)", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// return true if socket or PID file of a running server exist.
+func serverRunning() bool {
+	if util.PathExists(socketPath) {
+		return true
 	}
-	return c
+	pid := getPID()
+	return pid != 0 && processRunning(pid)
 }
 
 // AppName returns the name of the application running the server.
 func (c *rpcClient) AppName() (string, error) {
-	var s string
-	err := c.client.Call("Firefox.AppName", "", &s)
-	return s, err
+	if err := c.connect(); err != nil {
+		return "", err
+	}
+	return c.appName, nil
 }
 
 // Ping checks connection to Firefox extension.
 func (c *rpcClient) Ping() error {
 	var s string
-	return c.client.Call("Firefox.Ping", "", &s)
+	return c.call("Firefox.Ping", "", &s)
+}
+
+// ExtensionInfo returns the version of the extension and the commands it supports.
+func (c *rpcClient) ExtensionInfo() (ExtensionInfo, error) {
+	var info ExtensionInfo
+	err := c.call("Firefox.ExtensionInfo", "", &info)
+	return info, err
 }
 
 // Bookmarks returns all Firefox bookmarks matching query.
 func (c *rpcClient) Bookmarks(query string) ([]Bookmark, error) {
 	var bookmarks []Bookmark
-	err := c.client.Call("Firefox.Bookmarks", query, &bookmarks)
+	err := c.call("Firefox.Bookmarks", query, &bookmarks)
 	return bookmarks, err
 }
 
+// BookmarkTree returns all bookmarks and folders with their folder paths.
+func (c *rpcClient) BookmarkTree() ([]Bookmark, error) {
+	var nodes []Bookmark
+	err := c.call("Firefox.BookmarkTree", "", &nodes)
+	return nodes, err
+}
+
+// CreateBookmark adds a bookmark to a folder.
+func (c *rpcClient) CreateBookmark(arg CreateBookmarkArg) (Bookmark, error) {
+	var bm Bookmark
+	err := c.call("Firefox.CreateBookmark", arg, &bm)
+	return bm, err
+}
+
+// UpdateBookmark changes a bookmark's title and/or URL.
+func (c *rpcClient) UpdateBookmark(arg UpdateBookmarkArg) (Bookmark, error) {
+	var bm Bookmark
+	err := c.call("Firefox.UpdateBookmark", arg, &bm)
+	return bm, err
+}
+
+// MoveBookmark moves a bookmark to position index in folder parentID.
+// If index is -1, the bookmark is moved to the end of the folder.
+func (c *rpcClient) MoveBookmark(bookmarkID, parentID string, index int) (Bookmark, error) {
+	var bm Bookmark
+	err := c.call("Firefox.MoveBookmark", MoveBookmarkArg{ID: bookmarkID, ParentID: parentID, Index: index}, &bm)
+	return bm, err
+}
+
+// DeleteBookmark deletes a bookmark.
+func (c *rpcClient) DeleteBookmark(bookmarkID string) error {
+	return c.call("Firefox.DeleteBookmark", bookmarkID, nil)
+}
+
 // History searches Firefox browsing history.
 func (c *rpcClient) History(query string) ([]History, error) {
 	var history []History
-	err := c.client.Call("Firefox.History", query, &history)
+	err := c.call("Firefox.History", query, &history)
+	return history, err
+}
+
+// SearchHistory searches Firefox browsing history within a date range.
+func (c *rpcClient) SearchHistory(arg SearchHistoryArg) ([]History, error) {
+	var history []History
+	err := c.call("Firefox.SearchHistory", arg, &history)
 	return history, err
 }
 
+// DeleteHistoryURL removes all visits to URL from history.
+func (c *rpcClient) DeleteHistoryURL(URL string) error {
+	return c.call("Firefox.DeleteHistoryURL", URL, nil)
+}
+
+// DeleteHistoryRange removes all visits between startTime and endTime
+// (ms since epoch) from history.
+func (c *rpcClient) DeleteHistoryRange(startTime, endTime int64) error {
+	return c.call("Firefox.DeleteHistoryRange", DeleteHistoryRangeArg{StartTime: startTime, EndTime: endTime}, nil)
+}
+
+// ForgetSite removes history for a domain in a time range and returns
+// how much was removed. With arg.DryRun, nothing is removed.
+func (c *rpcClient) ForgetSite(arg ForgetSiteArg) (ForgetSiteResult, error) {
+	var res ForgetSiteResult
+	err := c.call("Firefox.ForgetSite", arg, &res)
+	return res, err
+}
+
+// Visits returns the visits to a page or domain in a time range.
+func (c *rpcClient) Visits(arg VisitsArg) ([]Visit, error) {
+	var visits []Visit
+	err := c.call("Firefox.Visits", arg, &visits)
+	return visits, err
+}
+
 // Downloads searches Firefox downloads.
 func (c *rpcClient) Downloads(query string) ([]Download, error) {
 	var downloads []Download
-	err := c.client.Call("Firefox.Downloads", query, &downloads)
+	err := c.call("Firefox.Downloads", query, &downloads)
 	return downloads, err
 }
 
+// Windows returns all Firefox windows with their tabs.
+func (c *rpcClient) Windows() ([]Window, error) {
+	var windows []Window
+	err := c.call("Firefox.Windows", "", &windows)
+	return windows, err
+}
+
+// FocusWindow brings the specified window to the front.
+func (c *rpcClient) FocusWindow(windowID int) error {
+	return c.call("Firefox.FocusWindow", windowID, nil)
+}
+
+// MinimizeWindow minimises the specified window.
+func (c *rpcClient) MinimizeWindow(windowID int) error {
+	return c.call("Firefox.MinimizeWindow", windowID, nil)
+}
+
+// CloseWindow closes the specified window and all its tabs.
+func (c *rpcClient) CloseWindow(windowID int) error {
+	return c.call("Firefox.CloseWindow", windowID, nil)
+}
+
+// NewWindow opens a new window.
+func (c *rpcClient) NewWindow(arg NewWindowArg) (Window, error) {
+	var win Window
+	err := c.call("Firefox.NewWindow", arg, &win)
+	return win, err
+}
+
 // Tabs returns all Firefox tabs.
 func (c *rpcClient) Tabs() ([]Tab, error) {
 	var tabs []Tab
-	err := c.client.Call("Firefox.Tabs", "", &tabs)
+	err := c.call("Firefox.Tabs", "", &tabs)
 	return tabs, err
 }
 
 // Tab returns the specified tab. If tabID is 0, returns the active tab.
 func (c *rpcClient) Tab(tabID int) (Tab, error) {
 	var tab Tab
-	err := c.client.Call("Firefox.Tab", tabID, &tab)
+	err := c.call("Firefox.Tab", tabID, &tab)
 	return tab, err
 }
 
+// CloseTab closes the specified tab.
+func (c *rpcClient) CloseTab(tabID int) error {
+	return c.call("Firefox.CloseTab", tabID, nil)
+}
+
+// CloseTabs closes the specified tabs.
+func (c *rpcClient) CloseTabs(tabIDs []int) error {
+	return c.call("Firefox.CloseTabs", tabIDs, nil)
+}
+
+// DuplicateTab duplicates the specified tab and returns the new tab.
+func (c *rpcClient) DuplicateTab(tabID int) (Tab, error) {
+	var tab Tab
+	err := c.call("Firefox.DuplicateTab", tabID, &tab)
+	return tab, err
+}
+
+// ReloadTab reloads the specified tab, optionally ignoring the browser cache.
+func (c *rpcClient) ReloadTab(tabID int, bypassCache bool) error {
+	return c.call("Firefox.ReloadTab", ReloadTabArg{TabID: tabID, BypassCache: bypassCache}, nil)
+}
+
+// PinTab pins or unpins the specified tab.
+func (c *rpcClient) PinTab(tabID int, pinned bool) error {
+	return c.call("Firefox.PinTab", PinTabArg{TabID: tabID, Pinned: pinned}, nil)
+}
+
+// MuteTab mutes or unmutes the specified tab.
+func (c *rpcClient) MuteTab(tabID int, muted bool) error {
+	return c.call("Firefox.MuteTab", MuteTabArg{TabID: tabID, Muted: muted}, nil)
+}
+
+// DiscardTab unloads the specified tab's content.
+func (c *rpcClient) DiscardTab(tabID int) error {
+	return c.call("Firefox.DiscardTab", tabID, nil)
+}
+
+// MoveTabToWindow moves the specified tab to another window. If windowID
+// is 0, the tab is moved to a new window.
+func (c *rpcClient) MoveTabToWindow(tabID, windowID int) error {
+	return c.call("Firefox.MoveTabToWindow", MoveTabArg{TabID: tabID, WindowID: windowID}, nil)
+}
+
+// MoveTabs moves the specified tabs, in order, to index in window windowID.
+func (c *rpcClient) MoveTabs(tabIDs []int, windowID, index int) error {
+	return c.call("Firefox.MoveTabs", MoveTabsArg{TabIDs: tabIDs, WindowID: windowID, Index: index}, nil)
+}
+
+// Containers returns all containers.
+func (c *rpcClient) Containers() ([]Container, error) {
+	var containers []Container
+	err := c.call("Firefox.Containers", "", &containers)
+	return containers, err
+}
+
+// ReopenTabInContainer reopens the specified tab in another container. If
+// cookieStoreID is empty, the tab is reopened outside any container.
+func (c *rpcClient) ReopenTabInContainer(tabID int, cookieStoreID string) (Tab, error) {
+	var tab Tab
+	err := c.call("Firefox.ReopenTabInContainer", ReopenTabArg{TabID: tabID, CookieStoreID: cookieStoreID}, &tab)
+	return tab, err
+}
+
+// RecentlyClosed returns up to max recently-closed tabs and windows. If max
+// is 0, the browser's maximum is returned.
+func (c *rpcClient) RecentlyClosed(max int) ([]Session, error) {
+	var sessions []Session
+	err := c.call("Firefox.RecentlyClosed", max, &sessions)
+	return sessions, err
+}
+
+// RestoreSession reopens a recently-closed tab or window.
+func (c *rpcClient) RestoreSession(sessionID string) (Session, error) {
+	var session Session
+	err := c.call("Firefox.RestoreSession", sessionID, &session)
+	return session, err
+}
+
 /*
 // CurrentTab returns the currently-active tab.
 func (c *rpcClient) CurrentTab() (Tab, error) {
 	var tab Tab
-	err := c.client.Call("Firefox.CurrentTab", "", &tab)
+	err := c.call("Firefox.CurrentTab", "", &tab)
 	return tab, err
 }
 */
 
 // ActivateTab brings the specified tab to the front.
 func (c *rpcClient) ActivateTab(tabID int) error {
-	return c.client.Call("Firefox.ActivateTab", tabID, nil)
+	return c.call("Firefox.ActivateTab", tabID, nil)
 }
 
 // CloseTabsLeft closes tabs to the left of specified tab.
 func (c *rpcClient) CloseTabsLeft(tabID int) error {
-	return c.client.Call("Firefox.CloseTabsLeft", tabID, nil)
+	return c.call("Firefox.CloseTabsLeft", tabID, nil)
 }
 
 // CloseTabsRight closes tabs to the right of specified tab.
 func (c *rpcClient) CloseTabsRight(tabID int) error {
-	return c.client.Call("Firefox.CloseTabsRight", tabID, nil)
+	return c.call("Firefox.CloseTabsRight", tabID, nil)
 }
 
 // CloseTabsOther closes other tabs in same window as the specified one.
 func (c *rpcClient) CloseTabsOther(tabID int) error {
-	return c.client.Call("Firefox.CloseTabsOther", tabID, nil)
+	return c.call("Firefox.CloseTabsOther", tabID, nil)
+}
+
+// OpenURL opens a URL in the browser and returns the tab it was opened in.
+func (c *rpcClient) OpenURL(arg OpenURLArg) (Tab, error) {
+	var tab Tab
+	err := c.call("Firefox.OpenURL", arg, &tab)
+	return tab, err
+}
+
+// Download returns the download with the given ID.
+func (c *rpcClient) Download(id int) (Download, error) {
+	var dl Download
+	err := c.call("Firefox.Download", id, &dl)
+	return dl, err
+}
+
+// DownloadURL downloads a URL with the browser and returns the new download.
+func (c *rpcClient) DownloadURL(arg DownloadURLArg) (Download, error) {
+	var dl Download
+	err := c.call("Firefox.DownloadURL", arg, &dl)
+	return dl, err
+}
+
+// PauseDownload pauses a download.
+func (c *rpcClient) PauseDownload(id int) error {
+	return c.call("Firefox.PauseDownload", id, nil)
+}
+
+// ResumeDownload resumes a paused or interrupted download.
+func (c *rpcClient) ResumeDownload(id int) error {
+	return c.call("Firefox.ResumeDownload", id, nil)
+}
+
+// CancelDownload cancels a download.
+func (c *rpcClient) CancelDownload(id int) error {
+	return c.call("Firefox.CancelDownload", id, nil)
+}
+
+// RetryDownload downloads the URL of a download again.
+func (c *rpcClient) RetryDownload(id int) (Download, error) {
+	var dl Download
+	err := c.call("Firefox.RetryDownload", id, &dl)
+	return dl, err
+}
+
+// EraseDownload removes a download from the list, leaving the file.
+func (c *rpcClient) EraseDownload(id int) error {
+	return c.call("Firefox.EraseDownload", id, nil)
+}
+
+// DeleteDownloadFile deletes a downloaded file, leaving it in the list.
+func (c *rpcClient) DeleteDownloadFile(id int) error {
+	return c.call("Firefox.DeleteDownloadFile", id, nil)
 }
 
 // OpenIncognito opens a URL in a new Incognito window.
 func (c *rpcClient) OpenIncognito(URL string) error {
-	return c.client.Call("Firefox.OpenIncognito", URL, nil)
+	return c.call("Firefox.OpenIncognito", URL, nil)
+}
+
+// Events waits up to wait seconds for events from the browser.
+// It returns an empty slice if no event occurs in that time. Events are
+// queued per connection, so the call isn't retried on a new one if the
+// connection fails, as the events queued on the old one would be lost.
+func (c *rpcClient) Events(wait int) ([]Event, error) {
+	var events []Event
+	err := c.call("Firefox.Events", wait, &events)
+	return events, err
 }
 
 // RunJS executes JavaScript in the specified tab. If tabID is 0, the
 // script is executed in the current tab.
 func (c *rpcClient) RunJS(arg RunJSArg) (string, error) {
 	var s string
-	err := c.client.Call("Firefox.RunJS", arg, &s)
+	err := c.call("Firefox.RunJS", arg, &s)
 	return s, err
 }
 
 // RunBookmarklet executes a given bookmarklet in a given tab.
 func (c *rpcClient) RunBookmarklet(arg RunBookmarkletArg) error {
-	return c.client.Call("Firefox.RunBookmarklet", arg, nil)
+	return c.call("Firefox.RunBookmarklet", arg, nil)
+}
+
+// connError is returned by jsonrpcClient if sending a request or reading
+// its response fails.
+type connError struct {
+	Err error
+}
+
+func (err connError) Error() string { return err.Err.Error() }
+
+// jsonrpcClient is a minimal JSON-RPC 2.0 client. Calls are made one at
+// a time. Errors returned by the server are of type *rpcError, and
+// errors reading from or writing to the connection of type connError.
+type jsonrpcClient struct {
+	mu     sync.Mutex // serialises calls
+	conn   net.Conn
+	enc    *json.Encoder
+	dec    *json.Decoder
+	lastID int
 }
+
+// dialJSONRPC connects to the JSON-RPC server on UNIX socket addr.
+func dialJSONRPC(addr string) (*jsonrpcClient, error) {
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonrpcClient{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		dec:  json.NewDecoder(conn),
+	}, nil
+}
+
+// Call invokes the named method with a single argument and unmarshals its
+// result into reply, which may be nil if the method has no result.
+func (c *jsonrpcClient) Call(method string, arg, reply interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastID++
+	id := strconv.Itoa(c.lastID)
+	params, err := json.Marshal([]interface{}{arg})
+	if err != nil {
+		return err
+	}
+	req := rpcRequest{
+		Version: "2.0",
+		Method:  method,
+		Params:  params,
+		ID:      json.RawMessage(id),
+	}
+	if err := c.enc.Encode(req); err != nil {
+		return connError{err}
+	}
+
+	var resp rpcResponse
+	if err := c.dec.Decode(&resp); err != nil {
+		return connError{err}
+	}
+	if string(resp.ID) != id {
+		return fmt.Errorf("response ID %s does not match request ID %s", resp.ID, id)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if reply == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, reply)
+}
+
+// Close closes the connection to the server.
+func (c *jsonrpcClient) Close() error { return c.conn.Close() }
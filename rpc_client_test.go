@@ -0,0 +1,127 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeServer is a JSON-RPC server on a UNIX socket. It answers
+// Firefox.AppName and passes other calls to respond, which returns the
+// JSON result to send, or an empty string to drop the connection.
+type fakeServer struct {
+	respond func(method string) string
+	conns   int32 // connections accepted
+	calls   int32 // calls other than Firefox.AppName
+}
+
+// newFakeServer starts a fakeServer and points socketPath at it. Call the
+// returned function to shut it down.
+func newFakeServer(t *testing.T, respond func(method string) string) (*fakeServer, func()) {
+	dir, err := ioutil.TempDir("", "alfred-firefox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSock, oldPID := socketPath, pidFile
+	socketPath = filepath.Join(dir, "server.sock")
+	pidFile = filepath.Join(dir, "server.pid")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeServer{respond: respond}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go s.serve(conn)
+		}
+	}()
+	return s, func() {
+		l.Close()
+		os.RemoveAll(dir)
+		socketPath, pidFile = oldSock, oldPID
+	}
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		var req rpcRequest
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			return
+		}
+		result := `"Firefox"`
+		if req.Method != "Firefox.AppName" {
+			atomic.AddInt32(&s.calls, 1)
+			if result = s.respond(req.Method); result == "" {
+				return
+			}
+		}
+		fmt.Fprintf(conn, `{"jsonrpc":"2.0","id":%s,"result":%s}`+"\n", req.ID, result)
+	}
+}
+
+// A result that can't be decoded is returned as is, without retrying the
+// call or reconnecting.
+func TestClientBadResult(t *testing.T) {
+	s, stop := newFakeServer(t, func(string) string { return `"not a list"` })
+	defer stop()
+
+	_, err := mustClient().Tabs()
+	if _, ok := err.(*json.UnmarshalTypeError); !ok {
+		t.Fatalf("expected *json.UnmarshalTypeError, got %T: %v", err, err)
+	}
+	if n := atomic.LoadInt32(&s.calls); n != 1 {
+		t.Errorf("expected 1 call, got %d", n)
+	}
+	if n := atomic.LoadInt32(&s.conns); n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+}
+
+// A dropped connection returns errConnectionLost. Only idempotent methods
+// are retried.
+func TestClientConnectionLost(t *testing.T) {
+	s, stop := newFakeServer(t, func(string) string { return "" })
+	defer stop()
+
+	err := mustClient().CloseTab(1)
+	if _, ok := err.(errConnectionLost); !ok {
+		t.Fatalf("expected errConnectionLost, got %T: %v", err, err)
+	}
+	if n := atomic.SwapInt32(&s.calls, 0); n != 1 {
+		t.Errorf("non-idempotent call sent %d times", n)
+	}
+
+	// event subscriptions belong to a connection
+	_, err = mustClient().Events(1)
+	if _, ok := err.(errConnectionLost); !ok {
+		t.Fatalf("expected errConnectionLost, got %T: %v", err, err)
+	}
+	if n := atomic.SwapInt32(&s.calls, 0); n != 1 {
+		t.Errorf("Events call sent %d times", n)
+	}
+
+	_, err = mustClient().Tabs()
+	if _, ok := err.(errConnectionLost); !ok {
+		t.Fatalf("expected errConnectionLost, got %T: %v", err, err)
+	}
+	if n := atomic.LoadInt32(&s.calls); n < 2 {
+		t.Errorf("idempotent call sent %d times, expected retries", n)
+	}
+}
@@ -4,37 +4,78 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"log"
 	"net"
-	"net/rpc"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/deanishe/awgo/util"
 )
 
+// Timeouts for extension commands.
+const (
+	timeoutShort   = time.Second * 2  // simple lookups, e.g. ping
+	timeoutDefault = time.Second * 5  // most commands
+	timeoutLong    = time.Second * 30 // searches that may return a lot of data
+	timeoutDialog  = time.Minute * 10 // commands that wait for the user, e.g. a "Save As" dialog
+)
+
+// errInvalidArg is returned if the arguments to an RPC method are invalid.
+type errInvalidArg struct {
+	Reason string
+}
+
+func (err errInvalidArg) Error() string { return err.Reason }
+
+// errCommand is returned if the extension reports that a command failed,
+// e.g. because there's no tab with the given ID.
+type errCommand struct {
+	Message string
+}
+
+func (err errCommand) Error() string { return err.Message }
+
+// notFound returns true if the extension failed the command because the
+// tab, window, bookmark, etc. it refers to doesn't exist.
+func (err errCommand) notFound() bool {
+	s := strings.ToLower(err.Message)
+	for _, sub := range []string{"not found", "no such", "no current", "invalid tab id",
+		"invalid window id", "invalid download id", "no download with id"} {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
 // rpcServer provides the RPC API. It passes commands and responses between
-// RPC clients and the Firefox extension.
+// RPC clients and the Firefox extension. Clients talk to the server via
+// JSON-RPC 2.0 over a UNIX socket. Its exported methods are the RPC methods,
+// and are called "Firefox.<Method>", e.g. "Firefox.Tabs".
+//
+// Each client connection is served by its own copy of rpcServer, whose
+// context is cancelled when the client disconnects.
 type rpcServer struct {
-	ff       *firefox // native application client run by FF extension
-	sock     string   // path to UNIX socket for RPC
+	ff       *firefox        // native application client run by FF extension
+	ctx      context.Context // cancelled when RPC client disconnects
+	sock     string          // path to UNIX socket for RPC
 	listener net.Listener
-	server   *rpc.Server
+
+	subscribe sync.Once    // start event subscription on first call to Events
+	events    <-chan Event // extension events for this client
 }
 
 // create new RPC server on socket specified by filepath addr
 func newRPCService(addr string, client *firefox) (*rpcServer, error) {
 	var err error
 	s := &rpcServer{
-		ff:     client,
-		sock:   addr,
-		server: rpc.NewServer(),
-	}
-
-	if err = s.server.RegisterName("Firefox", s); err != nil {
-		return nil, err
+		ff:   client,
+		ctx:  context.Background(),
+		sock: addr,
 	}
 
 	if s.listener, err = net.Listen("unix", s.sock); err != nil {
@@ -58,35 +99,116 @@ func (s *rpcServer) AppName(_ string, name *string) error {
 func (s *rpcServer) Ping(_ string, result *string) error {
 	defer util.Timed(time.Now(), "ping")
 	var r responseString
-	if err := s.ff.call("ping", nil, &r); err != nil {
+	if err := s.call("ping", timeoutShort, nil, &r); err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
 	}
 	*result = r.String
 	return nil
 }
 
-// func (s *rpcServer) Windows(_ string, windows *[]Window) error {
-// 	defer util.Timed(time.Now(), "get windows")
-// 	var r responseWindows
-// 	if err := s.ff.call("all-windows", nil, &r); err != nil {
-// 		return err
-// 	}
-// 	*windows = r.Windows
-// 	return nil
-// }
+// ExtensionInfo returns the version of the extension and the commands it supports.
+func (s *rpcServer) ExtensionInfo(_ string, info *ExtensionInfo) error {
+	if i, ok := s.ff.extensionInfo(); ok {
+		*info = i
+		return nil
+	}
+	// handshake failed at startup, e.g. because extension was busy
+	ctx, cancel := context.WithTimeout(s.ctx, timeoutShort)
+	defer cancel()
+	i, err := s.ff.handshake(ctx)
+	if err != nil {
+		return err
+	}
+	*info = i
+	return nil
+}
+
+// Windows returns all Firefox windows with their tabs.
+func (s *rpcServer) Windows(_ string, windows *[]Window) error {
+	defer util.Timed(time.Now(), "get windows")
+	var r responseWindows
+	if err := s.call("all-windows", timeoutDefault, nil, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*windows = r.Windows
+	return nil
+}
+
+// FocusWindow brings the specified window to the front.
+func (s *rpcServer) FocusWindow(windowID int, _ *struct{}) error {
+	defer util.Timed(time.Now(), "focus window")
+	var r responseNone
+	if err := s.call("focus-window", timeoutShort, windowID, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// MinimizeWindow minimises the specified window.
+func (s *rpcServer) MinimizeWindow(windowID int, _ *struct{}) error {
+	defer util.Timed(time.Now(), "minimise window")
+	var r responseNone
+	if err := s.call("minimize-window", timeoutShort, windowID, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// CloseWindow closes the specified window and all its tabs.
+func (s *rpcServer) CloseWindow(windowID int, _ *struct{}) error {
+	defer util.Timed(time.Now(), "close window")
+	var r responseNone
+	if err := s.call("close-window", timeoutDefault, windowID, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// NewWindowArg is the arguments for NewWindow call. If URL is empty, the
+// window opens the user's new tab page.
+type NewWindowArg struct {
+	URL       string `json:"url"`
+	Incognito bool   `json:"incognito"`
+}
+
+// NewWindow opens a new window and returns it.
+func (s *rpcServer) NewWindow(arg NewWindowArg, win *Window) error {
+	defer util.Timed(time.Now(), "new window")
+	var r responseWindow
+	if err := s.call("new-window", timeoutDefault, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*win = r.Window
+	return nil
+}
 
 // Tabs returns all Firefox tabs.
 func (s *rpcServer) Tabs(_ string, tabs *[]Tab) error {
 	defer util.Timed(time.Now(), "get tabs")
 	var r responseTabs
-	if err := s.ff.call("all-tabs", nil, &r); err != nil {
+	if err := s.call("all-tabs", timeoutDefault, nil, &r); err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
 	}
 	*tabs = r.Tabs
 	return nil
@@ -96,11 +218,11 @@ func (s *rpcServer) Tabs(_ string, tabs *[]Tab) error {
 func (s *rpcServer) ActivateTab(tabID int, _ *struct{}) error {
 	defer util.Timed(time.Now(), "activate tab")
 	var r responseNone
-	if err := s.ff.call("activate-tab", tabID, &r); err != nil {
+	if err := s.call("activate-tab", timeoutShort, tabID, &r); err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
 	}
 	return nil
 }
@@ -109,26 +231,179 @@ func (s *rpcServer) ActivateTab(tabID int, _ *struct{}) error {
 func (s *rpcServer) Tab(tabID int, tab *Tab) error {
 	defer util.Timed(time.Now(), "get tab")
 	var r responseTab
-	if err := s.ff.call("tab", tabID, &r); err != nil {
+	if err := s.call("tab", timeoutShort, tabID, &r); err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
 	}
 	*tab = r.Tab
 	return nil
 }
 
+// CloseTab closes the specified tab.
+func (s *rpcServer) CloseTab(tabID int, _ *struct{}) error {
+	defer util.Timed(time.Now(), "close tab")
+	var r responseNone
+	if err := s.call("close-tab", timeoutDefault, tabID, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// CloseTabs closes the specified tabs.
+func (s *rpcServer) CloseTabs(tabIDs []int, _ *struct{}) error {
+	defer util.Timed(time.Now(), fmt.Sprintf("close %d tab(s)", len(tabIDs)))
+	var r responseNone
+	if err := s.call("close-tabs", timeoutDefault, tabIDs, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// DuplicateTab duplicates the specified tab and returns the new tab.
+func (s *rpcServer) DuplicateTab(tabID int, tab *Tab) error {
+	defer util.Timed(time.Now(), "duplicate tab")
+	var r responseTab
+	if err := s.call("duplicate-tab", timeoutDefault, tabID, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*tab = r.Tab
+	return nil
+}
+
+// ReloadTabArg is the arguments for ReloadTab call.
+type ReloadTabArg struct {
+	TabID       int  `json:"tabId"`
+	BypassCache bool `json:"bypassCache"` // ignore browser cache
+}
+
+// ReloadTab reloads the specified tab.
+func (s *rpcServer) ReloadTab(arg ReloadTabArg, _ *struct{}) error {
+	defer util.Timed(time.Now(), "reload tab")
+	var r responseNone
+	if err := s.call("reload-tab", timeoutDefault, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// PinTabArg is the arguments for PinTab call.
+type PinTabArg struct {
+	TabID  int  `json:"tabId"`
+	Pinned bool `json:"pinned"` // false to unpin tab
+}
+
+// PinTab pins or unpins the specified tab.
+func (s *rpcServer) PinTab(arg PinTabArg, _ *struct{}) error {
+	defer util.Timed(time.Now(), "pin tab")
+	var r responseNone
+	if err := s.call("pin-tab", timeoutShort, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// MuteTabArg is the arguments for MuteTab call.
+type MuteTabArg struct {
+	TabID int  `json:"tabId"`
+	Muted bool `json:"muted"` // false to unmute tab
+}
+
+// MuteTab mutes or unmutes the specified tab.
+func (s *rpcServer) MuteTab(arg MuteTabArg, _ *struct{}) error {
+	defer util.Timed(time.Now(), "mute tab")
+	var r responseNone
+	if err := s.call("mute-tab", timeoutShort, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// DiscardTab unloads the specified tab's content to free memory. The tab
+// is reloaded when it is next activated. The active tab can't be discarded.
+func (s *rpcServer) DiscardTab(tabID int, _ *struct{}) error {
+	defer util.Timed(time.Now(), "discard tab")
+	var r responseNone
+	if err := s.call("discard-tab", timeoutDefault, tabID, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// MoveTabArg is the arguments for MoveTabToWindow call. If WindowID is 0,
+// the tab is moved to a new window.
+type MoveTabArg struct {
+	TabID    int `json:"tabId"`
+	WindowID int `json:"windowId"`
+}
+
+// MoveTabToWindow moves the specified tab to the end of another window.
+func (s *rpcServer) MoveTabToWindow(arg MoveTabArg, _ *struct{}) error {
+	defer util.Timed(time.Now(), "move tab to window")
+	var r responseNone
+	if err := s.call("move-tab-to-window", timeoutDefault, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// MoveTabsArg is the arguments for MoveTabs call.
+type MoveTabsArg struct {
+	TabIDs   []int `json:"tabIds"`
+	WindowID int   `json:"windowId"`
+	Index    int   `json:"index"`
+}
+
+// MoveTabs moves the specified tabs, in the given order, to position Index
+// in window WindowID. Tabs may come from any window. An Index of -1 moves
+// the tabs to the end of the window.
+func (s *rpcServer) MoveTabs(arg MoveTabsArg, _ *struct{}) error {
+	defer util.Timed(time.Now(), "move tabs")
+	var r responseNone
+	if err := s.call("move-tabs", timeoutDefault, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
 /*
 // CurrentTab returns the currently-active tab.
 func (s *rpcServer) CurrentTab(_ string, tab *Tab) error {
 	defer util.Timed(time.Now(), "get current tab")
 	var r responseTab
-	if err := s.ff.call("tab", 0, &r); err != nil {
+	if err := s.call("tab", timeoutShort, 0, &r); err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
 	}
 	*tab = r.Tab
 	return nil
@@ -139,11 +414,11 @@ func (s *rpcServer) CurrentTab(_ string, tab *Tab) error {
 func (s *rpcServer) CloseTabsLeft(tabID int, _ *struct{}) error {
 	defer util.Timed(time.Now(), "close tabs to left")
 	var r responseNone
-	if err := s.ff.call("close-tabs-left", tabID, &r); err != nil {
+	if err := s.call("close-tabs-left", timeoutDefault, tabID, &r); err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
 	}
 	return nil
 }
@@ -152,11 +427,11 @@ func (s *rpcServer) CloseTabsLeft(tabID int, _ *struct{}) error {
 func (s *rpcServer) CloseTabsRight(tabID int, _ *struct{}) error {
 	defer util.Timed(time.Now(), "close tabs to right")
 	var r responseNone
-	if err := s.ff.call("close-tabs-right", tabID, &r); err != nil {
+	if err := s.call("close-tabs-right", timeoutDefault, tabID, &r); err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
 	}
 	return nil
 }
@@ -165,11 +440,11 @@ func (s *rpcServer) CloseTabsRight(tabID int, _ *struct{}) error {
 func (s *rpcServer) CloseTabsOther(tabID int, _ *struct{}) error {
 	defer util.Timed(time.Now(), "close other tabs")
 	var r responseNone
-	if err := s.ff.call("close-tabs-other", tabID, &r); err != nil {
+	if err := s.call("close-tabs-other", timeoutDefault, tabID, &r); err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
 	}
 	return nil
 }
@@ -182,20 +457,156 @@ func (s *rpcServer) Bookmarks(query string, bookmarks *[]Bookmark) error {
 		err error
 	)
 	if query == "" {
-		err = s.ff.call("all-bookmarks", nil, &r)
+		err = s.call("all-bookmarks", timeoutLong, nil, &r)
 	} else {
-		err = s.ff.call("search-bookmarks", query, &r)
+		err = s.call("search-bookmarks", timeoutLong, query, &r)
 	}
 	if err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
+	}
+
+	// older extensions don't return folder paths, so add them from the
+	// folder tree. Paths are only cosmetic, so a failure doesn't fail the
+	// search.
+	if missingPaths(r.Bookmarks) {
+		var nodes []Bookmark
+		if err := s.BookmarkTree("", &nodes); err != nil {
+			log.Printf("[WARNING] bookmark folder paths: %v", err)
+		}
+		paths := make(map[string]string, len(nodes))
+		for _, bm := range nodes {
+			paths[bm.ID] = bm.Path
+		}
+		for i, bm := range r.Bookmarks {
+			r.Bookmarks[i].Path = paths[bm.ID]
+		}
 	}
+
 	*bookmarks = r.Bookmarks
 	return nil
 }
 
+// missingPaths returns true if any of bookmarks has no folder path. Every
+// bookmark is in a folder, so only extensions that don't send paths
+// return bookmarks without one.
+func missingPaths(bookmarks []Bookmark) bool {
+	for _, bm := range bookmarks {
+		if bm.Path == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// BookmarkTree returns all bookmarks and folders with their folder paths.
+// Each folder is listed before its contents.
+func (s *rpcServer) BookmarkTree(_ string, nodes *[]Bookmark) error {
+	defer util.Timed(time.Now(), "get bookmark tree")
+	var r responseBookmarks
+	if err := s.call("bookmark-tree", timeoutLong, nil, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	tree := newBookmarkTree(r.Bookmarks)
+	for i, bm := range r.Bookmarks {
+		r.Bookmarks[i].Path = tree.path(bm.ID)
+	}
+	*nodes = r.Bookmarks
+	return nil
+}
+
+// CreateBookmarkArg is the arguments for CreateBookmark call.
+type CreateBookmarkArg struct {
+	ParentID string `json:"parentId"` // folder to create bookmark in; "Other Bookmarks" if empty
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+}
+
+// CreateBookmark adds a bookmark at the end of a folder and returns it.
+func (s *rpcServer) CreateBookmark(arg CreateBookmarkArg, bm *Bookmark) error {
+	defer util.Timed(time.Now(), "create bookmark")
+	if arg.URL == "" {
+		return errInvalidArg{"empty URL"}
+	}
+	var r responseBookmark
+	if err := s.call("create-bookmark", timeoutDefault, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*bm = r.Bookmark
+	return nil
+}
+
+// UpdateBookmarkArg is the arguments for UpdateBookmark call. Empty fields
+// are left unchanged.
+type UpdateBookmarkArg struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// UpdateBookmark changes a bookmark's title and/or URL and returns
+// the updated bookmark.
+func (s *rpcServer) UpdateBookmark(arg UpdateBookmarkArg, bm *Bookmark) error {
+	defer util.Timed(time.Now(), "update bookmark")
+	if arg.Title == "" && arg.URL == "" {
+		return errInvalidArg{"nothing to update"}
+	}
+	var r responseBookmark
+	if err := s.call("update-bookmark", timeoutDefault, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*bm = r.Bookmark
+	return nil
+}
+
+// MoveBookmarkArg is the arguments for MoveBookmark call.
+type MoveBookmarkArg struct {
+	ID       string `json:"id"`
+	ParentID string `json:"parentId"` // destination folder
+	Index    int    `json:"index"`    // position in folder; -1 for the end
+}
+
+// MoveBookmark moves a bookmark or folder to another folder and returns it.
+func (s *rpcServer) MoveBookmark(arg MoveBookmarkArg, bm *Bookmark) error {
+	defer util.Timed(time.Now(), "move bookmark")
+	if arg.ParentID == "" {
+		return errInvalidArg{"no destination folder"}
+	}
+	var r responseBookmark
+	if err := s.call("move-bookmark", timeoutDefault, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*bm = r.Bookmark
+	return nil
+}
+
+// DeleteBookmark deletes a bookmark or an empty folder.
+func (s *rpcServer) DeleteBookmark(bookmarkID string, _ *struct{}) error {
+	defer util.Timed(time.Now(), "delete bookmark")
+	var r responseNone
+	if err := s.call("delete-bookmark", timeoutDefault, bookmarkID, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
 // History searches Firefox browsing history.
 func (s *rpcServer) History(query string, history *[]History) error {
 	defer util.Timed(time.Now(), fmt.Sprintf("search history for %q", query))
@@ -203,17 +614,254 @@ func (s *rpcServer) History(query string, history *[]History) error {
 		r   responseHistory
 		err error
 	)
-	err = s.ff.call("search-history", query, &r)
+	err = s.call("search-history", timeoutLong, query, &r)
 	if err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
+	}
+	*history = r.Entries
+	return nil
+}
+
+// SearchHistoryArg is the arguments for SearchHistory call.
+type SearchHistoryArg struct {
+	Text       string `json:"text"`       // words to find in title or URL; empty matches all pages
+	StartTime  int64  `json:"startTime"`  // only pages visited after this time (ms since epoch); 0 = no limit
+	EndTime    int64  `json:"endTime"`    // only pages visited before this time (ms since epoch); 0 = now
+	MaxResults int    `json:"maxResults"` // maximum number of results; 0 = 200
+}
+
+// SearchHistory searches Firefox browsing history within a date range.
+// Entries are sorted by last visit, newest first.
+func (s *rpcServer) SearchHistory(arg SearchHistoryArg, history *[]History) error {
+	defer util.Timed(time.Now(), fmt.Sprintf("search history for %q", arg.Text))
+	var r responseHistory
+	if err := s.call("query-history", timeoutLong, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
 	}
 	*history = r.Entries
 	return nil
 }
 
+// DeleteHistoryURL removes all visits to URL from history.
+func (s *rpcServer) DeleteHistoryURL(URL string, _ *struct{}) error {
+	defer util.Timed(time.Now(), "delete history URL")
+	if URL == "" {
+		return errInvalidArg{"empty URL"}
+	}
+	return s.deleteHistoryURLs([]string{URL})
+}
+
+// deleteHistoryURLs removes all visits to URLs from history.
+func (s *rpcServer) deleteHistoryURLs(URLs []string) error {
+	var r responseNone
+	if err := s.call("delete-history-urls", timeoutLong, URLs, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// DeleteHistoryRangeArg is the arguments for DeleteHistoryRange call.
+type DeleteHistoryRangeArg struct {
+	StartTime int64 `json:"startTime"` // delete visits after this time (ms since epoch)
+	EndTime   int64 `json:"endTime"`   // delete visits before this time (ms since epoch); 0 = now
+}
+
+// DeleteHistoryRange removes all visits in a time range from history.
+func (s *rpcServer) DeleteHistoryRange(arg DeleteHistoryRangeArg, _ *struct{}) error {
+	defer util.Timed(time.Now(), "delete history range")
+	var r responseNone
+	if err := s.call("delete-history-range", timeoutLong, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// ForgetSiteArg is the arguments for ForgetSite call.
+type ForgetSiteArg struct {
+	Domain    string `json:"domain"`    // domain to forget, including its subdomains
+	StartTime int64  `json:"startTime"` // only visits after this time (ms since epoch); 0 = no limit
+	EndTime   int64  `json:"endTime"`   // only visits before this time (ms since epoch); 0 = now
+	DryRun    bool   `json:"dryRun"`    // only report what would be deleted
+}
+
+// ForgetSiteResult is the result of a ForgetSite call.
+type ForgetSiteResult struct {
+	Pages     int  `json:"pages"`     // pages removed from history with all their visits
+	Visits    int  `json:"visits"`    // visits removed from pages with other visits outside the time range
+	Truncated bool `json:"truncated"` // more pages matched than forgetMaxResults; call again to delete the rest
+}
+
+// ForgetSite removes history for a domain and its subdomains. Without a
+// time range, all pages on the domain are removed. With one, only visits
+// in the range are removed, and pages that have no other visits are
+// removed entirely. At most forgetMaxResults pages are looked at per call.
+func (s *rpcServer) ForgetSite(arg ForgetSiteArg, res *ForgetSiteResult) error {
+	defer util.Timed(time.Now(), fmt.Sprintf("forget site %q", arg.Domain))
+	if arg.Domain == "" {
+		return errInvalidArg{"no domain"}
+	}
+	// pages last visited after EndTime may have been visited in range, too
+	var history []History
+	err := s.SearchHistory(SearchHistoryArg{
+		Text:       arg.Domain,
+		StartTime:  arg.StartTime,
+		MaxResults: forgetMaxResults,
+	}, &history)
+	if err != nil {
+		return err
+	}
+
+	var (
+		URLs   []string // pages to remove
+		visits []Visit  // visits to remove from pages that stay in history
+	)
+	for _, h := range siteHistory(history, arg.Domain) {
+		URLs = append(URLs, h.URL)
+	}
+	if len(URLs) > 0 && (arg.StartTime != 0 || arg.EndTime != 0) {
+		var r responseVisits
+		if err := s.call("get-visits", timeoutLong, URLs, &r); err != nil {
+			return err
+		}
+		if r.Error != "" {
+			return errCommand{r.Error}
+		}
+		URLs, visits = splitVisits(r.Visits, arg.StartTime, arg.EndTime)
+	}
+
+	*res = ForgetSiteResult{
+		Pages:     len(URLs),
+		Visits:    len(visits),
+		Truncated: len(history) >= forgetMaxResults,
+	}
+	if arg.DryRun {
+		return nil
+	}
+	if len(URLs) > 0 {
+		if err := s.deleteHistoryURLs(URLs); err != nil {
+			return err
+		}
+	}
+	if len(visits) > 0 {
+		times := make([]int64, len(visits))
+		for i, v := range visits {
+			times[i] = v.VisitTime
+		}
+		var r responseNone
+		if err := s.call("delete-history-visits", timeoutLong, times, &r); err != nil {
+			return err
+		}
+		if r.Error != "" {
+			return errCommand{r.Error}
+		}
+	}
+	return nil
+}
+
+// splitVisits sorts the visits between start and end (ms since epoch; 0 =
+// no limit) into pages all of whose visits are in the range, which can be
+// removed entirely, and visits to pages that were also visited outside it.
+func splitVisits(all []Visit, start, end int64) (URLs []string, visits []Visit) {
+	var (
+		byURL = map[string][]Visit{}
+		order []string
+	)
+	for _, v := range all {
+		if _, ok := byURL[v.URL]; !ok {
+			order = append(order, v.URL)
+		}
+		byURL[v.URL] = append(byURL[v.URL], v)
+	}
+	for _, u := range order {
+		inRange := filterVisits(byURL[u], start, end)
+		switch len(inRange) {
+		case 0:
+		case len(byURL[u]):
+			URLs = append(URLs, u)
+		default:
+			visits = append(visits, inRange...)
+		}
+	}
+	return URLs, visits
+}
+
+// VisitsArg is the arguments for Visits call. Either URL or Domain must be set.
+type VisitsArg struct {
+	URL       string `json:"url"`       // page to get visits to
+	Domain    string `json:"domain"`    // get visits to pages on this domain and its subdomains
+	StartTime int64  `json:"startTime"` // only visits after this time (ms since epoch); 0 = no limit
+	EndTime   int64  `json:"endTime"`   // only visits before this time (ms since epoch); 0 = now
+}
+
+// Visits returns the visits to a page or to the pages on a domain, most
+// recent first.
+func (s *rpcServer) Visits(arg VisitsArg, visits *[]Visit) error {
+	defer util.Timed(time.Now(), fmt.Sprintf("visits to %q", arg.URL+arg.Domain))
+	var (
+		history []History
+		search  = SearchHistoryArg{StartTime: arg.StartTime, MaxResults: visitsMaxPages}
+	)
+	switch {
+	case arg.URL != "":
+		search.Text = arg.URL
+	case arg.Domain != "":
+		search.Text = arg.Domain
+	default:
+		return errInvalidArg{"no URL or domain"}
+	}
+	// pages last visited before EndTime may have been visited in range, too
+	if err := s.SearchHistory(search, &history); err != nil {
+		return err
+	}
+
+	titles := map[string]string{} // URLs to get visits to
+	if arg.URL != "" {
+		titles[arg.URL] = ""
+		for _, h := range history {
+			if h.URL == arg.URL {
+				titles[h.URL] = h.Title
+			}
+		}
+	} else {
+		for _, h := range siteHistory(history, arg.Domain) {
+			titles[h.URL] = h.Title
+		}
+	}
+	URLs := make([]string, 0, len(titles))
+	for u := range titles {
+		URLs = append(URLs, u)
+	}
+	if len(URLs) == 0 {
+		*visits = []Visit{}
+		return nil
+	}
+
+	var r responseVisits
+	if err := s.call("get-visits", timeoutLong, URLs, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	for i, v := range r.Visits {
+		r.Visits[i].Title = titles[v.URL]
+	}
+	*visits = filterVisits(r.Visits, arg.StartTime, arg.EndTime)
+	return nil
+}
+
 // Downloads searches Firefox downloads.
 func (s *rpcServer) Downloads(query string, downloads *[]Download) error {
 	defer util.Timed(time.Now(), fmt.Sprintf("search download for %q", query))
@@ -221,30 +869,333 @@ func (s *rpcServer) Downloads(query string, downloads *[]Download) error {
 		r   responseDownload
 		err error
 	)
-	err = s.ff.call("search-downloads", query, &r)
+	err = s.call("search-downloads", timeoutLong, query, &r)
 	if err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
 	}
 	*downloads = r.Downloads
 	return nil
 }
 
+// Download returns the download with the given ID.
+func (s *rpcServer) Download(id int, dl *Download) error {
+	defer util.Timed(time.Now(), fmt.Sprintf("get download #%d", id))
+	var r responseDownloadItem
+	if err := s.call("get-download", timeoutShort, id, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*dl = r.Download
+	return nil
+}
+
+// DownloadURLArg is the arguments for DownloadURL call.
+type DownloadURLArg struct {
+	URL string `json:"url"`
+	// Path of file relative to the downloads directory. If empty, the
+	// browser chooses the name.
+	Filename string `json:"filename"`
+	// Whether to ask the user where to save the file.
+	SaveAs bool `json:"saveAs"`
+}
+
+// DownloadURL downloads a URL with the browser, which sends its cookies,
+// and returns the new download. If SaveAs is set, the call waits for the
+// user to choose a file, so it has a much longer timeout.
+func (s *rpcServer) DownloadURL(arg DownloadURLArg, dl *Download) error {
+	defer util.Timed(time.Now(), fmt.Sprintf("download %q", arg.URL))
+	if arg.URL == "" {
+		return errInvalidArg{"empty URL"}
+	}
+	timeout := timeoutLong
+	if arg.SaveAs {
+		timeout = timeoutDialog
+	}
+	var r responseDownloadItem
+	if err := s.call("download-url", timeout, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*dl = r.Download
+	return nil
+}
+
+// PauseDownload pauses a download.
+func (s *rpcServer) PauseDownload(id int, _ *struct{}) error {
+	defer util.Timed(time.Now(), "pause download")
+	var r responseNone
+	if err := s.call("pause-download", timeoutDefault, id, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// ResumeDownload resumes a paused or interrupted download.
+func (s *rpcServer) ResumeDownload(id int, _ *struct{}) error {
+	defer util.Timed(time.Now(), "resume download")
+	var r responseNone
+	if err := s.call("resume-download", timeoutDefault, id, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// CancelDownload cancels a download.
+func (s *rpcServer) CancelDownload(id int, _ *struct{}) error {
+	defer util.Timed(time.Now(), "cancel download")
+	var r responseNone
+	if err := s.call("cancel-download", timeoutDefault, id, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// RetryDownload downloads the URL of a download again and returns the
+// new download.
+func (s *rpcServer) RetryDownload(id int, dl *Download) error {
+	defer util.Timed(time.Now(), "retry download")
+	var r responseDownloadItem
+	if err := s.call("retry-download", timeoutDefault, id, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*dl = r.Download
+	return nil
+}
+
+// EraseDownload removes a download from the list. The file isn't deleted.
+func (s *rpcServer) EraseDownload(id int, _ *struct{}) error {
+	defer util.Timed(time.Now(), "erase download")
+	var r responseNone
+	if err := s.call("erase-download", timeoutDefault, id, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
+// DeleteDownloadFile deletes a downloaded file. The download stays in
+// the list.
+func (s *rpcServer) DeleteDownloadFile(id int, _ *struct{}) error {
+	defer util.Timed(time.Now(), "delete downloaded file")
+	var r responseNone
+	if err := s.call("delete-download-file", timeoutDefault, id, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	return nil
+}
+
 // OpenIncognito opens URL in a new incognito window.
 func (s *rpcServer) OpenIncognito(URL string, _ *struct{}) error {
 	defer util.Timed(time.Now(), "open incognito")
 	var r responseNone
-	if err := s.ff.call("open-incognito", URL, &r); err != nil {
+	if err := s.call("open-incognito", timeoutDefault, URL, &r); err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
 	}
 	return nil
 }
 
+// Containers returns all containers. The list is empty if containers are
+// disabled in the browser.
+func (s *rpcServer) Containers(_ string, containers *[]Container) error {
+	defer util.Timed(time.Now(), "get containers")
+	var r responseContainers
+	if err := s.call("all-containers", timeoutDefault, nil, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*containers = r.Containers
+	return nil
+}
+
+// ReopenTabArg is the arguments for ReopenTabInContainer call. If
+// CookieStoreID is empty, the tab is reopened outside any container.
+type ReopenTabArg struct {
+	TabID         int    `json:"tabId"`
+	CookieStoreID string `json:"cookieStoreId"`
+}
+
+// ReopenTabInContainer opens the specified tab's URL in a new tab in another
+// container, next to the original tab, and closes the original. It returns
+// the new tab.
+func (s *rpcServer) ReopenTabInContainer(arg ReopenTabArg, tab *Tab) error {
+	defer util.Timed(time.Now(), "reopen tab in container")
+	if arg.CookieStoreID == "" {
+		arg.CookieStoreID = defaultContainer
+	}
+	var r responseTab
+	if err := s.call("reopen-tab-in-container", timeoutDefault, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*tab = r.Tab
+	return nil
+}
+
+// RecentlyClosed returns up to max recently-closed tabs and windows, most
+// recently closed first. If max is 0, the browser's maximum (25) is returned.
+func (s *rpcServer) RecentlyClosed(max int, sessions *[]Session) error {
+	defer util.Timed(time.Now(), "get recently closed")
+	var r responseSessions
+	if err := s.call("recently-closed", timeoutDefault, max, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*sessions = r.Sessions
+	return nil
+}
+
+// RestoreSession reopens a recently-closed tab or window.
+func (s *rpcServer) RestoreSession(sessionID string, session *Session) error {
+	defer util.Timed(time.Now(), "restore session")
+	var r responseSession
+	if err := s.call("restore-session", timeoutDefault, sessionID, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*session = r.Session
+	return nil
+}
+
+// Targets for OpenURL.
+const (
+	openCurrentTab    = "current"    // load URL in active tab
+	openNewTab        = "tab"        // open URL in a new tab (default)
+	openBackgroundTab = "background" // open URL in a new tab without activating it
+	openNewWindow     = "window"     // open URL in a new window
+)
+
+// OpenURLArg is the arguments for OpenURL call.
+type OpenURLArg struct {
+	URL    string `json:"url"`    // new tab page if empty
+	Target string `json:"target"` // where to open URL; one of the open* constants
+	// Window to open tab in. If 0, the current window is used.
+	// Ignored by openNewWindow.
+	WindowID int `json:"windowId"`
+	// Where to put a new tab: "start", "end", "next" (after the active tab)
+	// or "" for the browser's default.
+	Position string `json:"position"`
+	// Container to open new tab or window in. If empty, the default
+	// container is used.
+	CookieStoreID string `json:"cookieStoreId"`
+}
+
+// validate checks that Target and Position have known values.
+func (arg OpenURLArg) validate() error {
+	switch arg.Target {
+	case "", openCurrentTab, openNewTab, openBackgroundTab, openNewWindow:
+	default:
+		return errInvalidArg{fmt.Sprintf("unknown target %q", arg.Target)}
+	}
+	switch arg.Position {
+	case "", "start", "end", "next":
+	default:
+		return errInvalidArg{fmt.Sprintf("unknown position %q", arg.Position)}
+	}
+	if arg.Target == openCurrentTab && arg.CookieStoreID != "" {
+		return errInvalidArg{"can't change container of existing tab"}
+	}
+	return nil
+}
+
+// OpenURL opens a URL in the browser and returns the tab it was opened in.
+func (s *rpcServer) OpenURL(arg OpenURLArg, tab *Tab) error {
+	defer util.Timed(time.Now(), "open URL")
+	if err := arg.validate(); err != nil {
+		return err
+	}
+	var r responseTab
+	if err := s.call("open-url", timeoutDefault, arg, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return errCommand{r.Error}
+	}
+	*tab = r.Tab
+	return nil
+}
+
+// maximum time Events waits for an event.
+const maxEventWait = time.Minute
+
+// Events waits up to wait seconds for the extension to push events and
+// returns them. Events are queued from the client's first call to Events
+// until it disconnects, so none are missed between calls. An empty list
+// is returned if no event occurs within wait seconds. Events waits at
+// most a minute, which is also the wait if wait is 0.
+func (s *rpcServer) Events(wait int, events *[]Event) error {
+	s.subscribe.Do(func() { s.events = s.ff.subscribe(s.ctx) })
+
+	d := time.Duration(wait) * time.Second
+	if d <= 0 || d > maxEventWait {
+		d = maxEventWait
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	var evs []Event
+	select {
+	case ev, ok := <-s.events:
+		if !ok {
+			return errStopped
+		}
+		evs = append(evs, ev)
+	case <-t.C:
+		*events = evs
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+	// collect any other queued events
+	for {
+		select {
+		case ev, ok := <-s.events:
+			if !ok {
+				*events = evs
+				return nil
+			}
+			evs = append(evs, ev)
+		default:
+			*events = evs
+			return nil
+		}
+	}
+}
+
 // RunJSArg is the arguments required for RunJS call. TabID may be 0, in which
 // case the JavaScript is executed in the active tab.
 type RunJSArg struct {
@@ -257,11 +1208,11 @@ type RunJSArg struct {
 func (s *rpcServer) RunJS(arg RunJSArg, JSON *string) error {
 	defer util.Timed(time.Now(), "execute JS")
 	var r responseString
-	if err := s.ff.call("execute-js", arg, &r); err != nil {
+	if err := s.call("execute-js", timeoutDefault, arg, &r); err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
 	}
 	*JSON = r.String
 	return nil
@@ -278,18 +1229,38 @@ type RunBookmarkletArg struct {
 func (s *rpcServer) RunBookmarklet(arg RunBookmarkletArg, _ *struct{}) error {
 	defer util.Timed(time.Now(), "run bookmarklet")
 	var r responseNone
-	if err := s.ff.call("run-bookmarklet", arg, &r); err != nil {
+	if err := s.call("run-bookmarklet", timeoutDefault, arg, &r); err != nil {
 		return err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return errCommand{r.Error}
 	}
 	return nil
 }
 
+// call passes a command to the extension. The command is abandoned if
+// it takes longer than timeout or the RPC client disconnects. It fails
+// immediately if the extension is known not to support the command.
+func (s *rpcServer) call(cmd string, timeout time.Duration, params, v interface{}) error {
+	if err := s.ff.supported(cmd); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+	return s.ff.call(ctx, cmd, params, v)
+}
+
+// accept client connections until the listener is closed.
 func (s *rpcServer) run() {
 	log.Printf("serving RPC on %q ...", s.sock)
-	s.server.Accept(s.listener)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			log.Printf("stopped accepting RPC connections: %v", err)
+			return
+		}
+		go s.serveConn(conn)
+	}
 }
 
 func (s *rpcServer) stop() error {
@@ -301,9 +1272,30 @@ type responseString struct {
 	Error  string `json:"error"`
 }
 
-// type responseWindows struct {
-// 	Windows []Window `json:"payload"`
-// }
+type responseWindows struct {
+	Windows []Window `json:"payload"`
+	Error   string   `json:"error"`
+}
+
+type responseSessions struct {
+	Sessions []Session `json:"payload"`
+	Error    string    `json:"error"`
+}
+
+type responseSession struct {
+	Session Session `json:"payload"`
+	Error   string  `json:"error"`
+}
+
+type responseContainers struct {
+	Containers []Container `json:"payload"`
+	Error      string      `json:"error"`
+}
+
+type responseWindow struct {
+	Window Window `json:"payload"`
+	Error  string `json:"error"`
+}
 
 type responseTabs struct {
 	Tabs  []Tab  `json:"payload"`
@@ -320,11 +1312,21 @@ type responseHistory struct {
 	Error   string    `json:"error"`
 }
 
+type responseVisits struct {
+	Visits []Visit `json:"payload"`
+	Error  string  `json:"error"`
+}
+
 type responseTabCurrent struct {
 	Tab   Tab    `json:"payload"`
 	Error string `json:"error"`
 }
 
+type responseBookmark struct {
+	Bookmark Bookmark `json:"payload"`
+	Error    string   `json:"error"`
+}
+
 type responseBookmarks struct {
 	Bookmarks []Bookmark `json:"payload"`
 	Error     string     `json:"error"`
@@ -335,6 +1337,11 @@ type responseDownload struct {
 	Error     string     `json:"error"`
 }
 
+type responseDownloadItem struct {
+	Download Download `json:"payload"`
+	Error    string   `json:"error"`
+}
+
 type responseBool struct {
 	OK    bool   `json:"payload"`
 	Error string `json:"error"`
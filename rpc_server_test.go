@@ -0,0 +1,52 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitVisits(t *testing.T) {
+	visit := func(url string, t int64) Visit { return Visit{URL: url, VisitTime: t} }
+	visits := []Visit{
+		visit("https://a.com/in", 15),
+		visit("https://a.com/in", 12),
+		visit("https://a.com/both", 25),
+		visit("https://a.com/both", 18),
+		visit("https://a.com/both", 5),
+		visit("https://a.com/out", 30),
+		visit("https://a.com/out", 1),
+	}
+
+	tests := []struct {
+		name       string
+		start, end int64
+		URLs       []string
+		times      []int64
+	}{
+		{"no limit", 0, 0, []string{"https://a.com/in", "https://a.com/both", "https://a.com/out"}, nil},
+		{"range", 10, 20, []string{"https://a.com/in"}, []int64{18}},
+		{"since", 10, 0, []string{"https://a.com/in"}, []int64{25, 18, 30}},
+		{"before", 0, 10, nil, []int64{5, 1}},
+		{"nothing in range", 40, 50, nil, nil},
+	}
+
+	for _, td := range tests {
+		td := td
+		t.Run(td.name, func(t *testing.T) {
+			URLs, visits := splitVisits(visits, td.start, td.end)
+			if !reflect.DeepEqual(URLs, td.URLs) {
+				t.Errorf("pages: expected=%v, got=%v", td.URLs, URLs)
+			}
+			var times []int64
+			for _, v := range visits {
+				times = append(times, v.VisitTime)
+			}
+			if !reflect.DeepEqual(times, td.times) {
+				t.Errorf("visits: expected=%v, got=%v", td.times, times)
+			}
+		})
+	}
+}
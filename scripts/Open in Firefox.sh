@@ -1,5 +0,0 @@
-#!/bin/zsh
-
-BROWSER="${BROWSER:-Firefox}"
-
-/usr/bin/open -a "$BROWSER" "$1"
@@ -4,6 +4,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,27 +18,37 @@ import (
 	"syscall"
 	"time"
 
-	aw "github.com/deanishe/awgo"
 	"github.com/deanishe/awgo/util"
 	"github.com/peterbourgon/ff/ffcli"
 )
 
 var (
 	// starts extension client & RPC server
-	serveCmd = &ffcli.Command{
+	serveFlags = flag.NewFlagSet("serve", flag.ExitOnError)
+	serveCmd   = &ffcli.Command{
 		Name:      "serve",
-		Usage:     "alfred-firefox serve",
+		Usage:     "alfred-firefox serve [-http <host:port>]",
 		ShortHelp: "start extension server (called by Firefox)",
 		LongHelp: wrap(`
 			Run extension server. This is called by the Firefox
 			extension and provides and RPC server for the workflow
 			to call into Firefox.
+
+			If -http is specified, the server also provides a REST
+			API on the given localhost address. Clients must send
+			the token in the workflow's data directory.
 		`),
-		Exec: runServer,
+		FlagSet: serveFlags,
+		Exec:    runServer,
 	}
 	browserName string
+	httpAddr    string
 )
 
+func init() {
+	serveFlags.StringVar(&httpAddr, "http", "", "also serve REST API on localhost address `host:port`")
+}
+
 // set up logging for the server.
 // doesn't use the same log as the rest of the workflow, as this is
 // a long-running process, and we don't want the log file it's using
@@ -118,7 +130,7 @@ func getBrowserName() (name string) {
 
 // start extension client and RPC server
 func runServer(_ []string) error {
-	wf.Configure(aw.TextErrors(true))
+	useTextErrors()
 	if err := writePID(); err != nil {
 		return err
 	}
@@ -144,6 +156,15 @@ func runServer(_ []string) error {
 	}
 	go srv.run()
 
+	var hsrv *httpServer
+	if httpAddr != "" {
+		if hsrv, err = newHTTPService(httpAddr, f); err != nil {
+			log.Printf("[ERROR] HTTP server: %v", err)
+		} else {
+			go hsrv.run()
+		}
+	}
+
 	var s string
 	if err := srv.Ping("", &s); err != nil {
 		log.Printf("[ERROR] %v", err)
@@ -151,6 +172,16 @@ func runServer(_ []string) error {
 		log.Printf("ping => %q", s)
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutShort)
+	if info, err := f.handshake(ctx); err != nil {
+		log.Printf("[ERROR] handshake: %v", err)
+	} else if info.Outdated() {
+		log.Printf("[WARNING] extension is outdated: version=%q, want >= %s", info.Version, minExtensionVersion)
+	} else {
+		log.Printf("extension version=%s, commands=%v", info.Version, info.Commands)
+	}
+	cancel()
+
 	/*
 		var bookmarks []Bookmark
 		for _, q := range []string{"", "haze", "github", "p2p"} {
@@ -171,6 +202,9 @@ func runServer(_ []string) error {
 
 	<-quit
 	log.Print("shutting down ...")
+	if hsrv != nil {
+		_ = hsrv.stop()
+	}
 	f.stop()
 	srv.stop()
 	return nil
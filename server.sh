@@ -22,5 +22,11 @@ export alfred_workflow_data="${HOME}/Library/Application Support/Alfred/Workflow
 mkdir -p "${alfred_workflow_data}"
 mkdir -p "${alfred_workflow_cache}"
 
+# Optional REST API, e.g. HTTP_ADDR=127.0.0.1:8321. Set in workflow configuration.
+http_addr=$( getvar "variables:HTTP_ADDR" 2>/dev/null )
+if [[ -n "$http_addr" ]]; then
+    exec "${here}/alfred-firefox" serve -http "$http_addr"
+fi
+
 exec "${here}/alfred-firefox" serve
 
@@ -0,0 +1,305 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	aw "github.com/deanishe/awgo"
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+const (
+	undoCacheName = "undo.json"     // tabs closed by last bulk close action
+	undoTimeout   = time.Minute * 5 // how long Undo is offered for
+	maxUndoTabs   = 25              // number of closed tabs Firefox remembers
+	recentTrigger = "recent"        // External Trigger that shows recent command
+)
+
+var (
+	// list recently-closed tabs and windows
+	recentCmd = &ffcli.Command{
+		Name:      "recent",
+		Usage:     "alfred-firefox [-query <query>] recent",
+		ShortHelp: "filter recently-closed tabs and windows",
+		LongHelp: wrap(`
+			Filter recently-closed tabs and windows and restore them.
+			If tabs were closed by a bulk close action in the last few
+			minutes, an Undo item is shown first.
+		`),
+		Exec: runRecent,
+	}
+
+	// restore recently-closed tab or window
+	restoreCmd = &ffcli.Command{
+		Name:      "restore",
+		Usage:     "alfred-firefox -session <id> restore\n  alfred-firefox -action undo restore",
+		ShortHelp: "restore closed tab or window",
+		LongHelp: wrap(`
+			Restore the specified recently-closed tab or window.
+			With -action undo, restore the tabs closed by the last
+			bulk close action.
+		`),
+		Exec: runRestore,
+	}
+)
+
+// undoRecord is the tabs closed by the last bulk close action.
+type undoRecord struct {
+	Action     string   `json:"action"`     // name of action that closed the tabs
+	SessionIDs []string `json:"sessionIds"` // closed tabs, most recently closed first
+	Closed     int      `json:"closed"`     // number of tabs closed; 0 if unknown
+}
+
+// lost returns the number of closed tabs that Undo can't reopen because
+// Firefox has forgotten them.
+func (rec undoRecord) lost() int {
+	if n := rec.Closed - len(rec.SessionIDs); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// countTabs returns the number of open tabs, or -1 if it can't be retrieved.
+func countTabs(c *rpcClient) int {
+	tabs, err := c.Tabs()
+	if err != nil {
+		log.Printf("[ERROR] count tabs: %v", err)
+		return -1
+	}
+	return len(tabs)
+}
+
+// pending returns the IDs of the tabs in the record that are still in
+// sessions, i.e. haven't been restored yet.
+func (rec undoRecord) pending(sessions []Session) []string {
+	closed := map[string]bool{}
+	for _, s := range sessions {
+		closed[s.ID] = true
+	}
+	var ids []string
+	for _, id := range rec.SessionIDs {
+		if closed[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// loadUndo returns the last undo record. ok is false if there is no record
+// or it's too old.
+func loadUndo() (rec undoRecord, ok bool) {
+	if !wf.Cache.Exists(undoCacheName) || wf.Cache.Expired(undoCacheName, undoTimeout) {
+		return undoRecord{}, false
+	}
+	if err := wf.Cache.LoadJSON(undoCacheName, &rec); err != nil {
+		log.Printf("[ERROR] load undo record: %v", err)
+		return undoRecord{}, false
+	}
+	return rec, true
+}
+
+// closeWithUndo calls fn, which closes tabs, then saves the closed tabs'
+// session IDs, so they can be restored, and shows the recent list with an
+// Undo item in Alfred. name is the name of the action that closes the tabs.
+//
+// Firefox only remembers the last maxUndoTabs closed tabs, so if more tabs
+// are closed, a warning is printed that Undo can't reopen them all.
+func closeWithUndo(c *rpcClient, name string, fn func() error) error {
+	var (
+		start  = time.Now().UnixNano() / int64(time.Millisecond)
+		before = countTabs(c)
+	)
+	if err := fn(); err != nil {
+		return err
+	}
+
+	// tabs have been closed, so only log errors from here on
+	sessions, err := c.RecentlyClosed(0)
+	if err != nil {
+		log.Printf("[ERROR] recently closed: %v", err)
+		return nil
+	}
+	rec := undoRecord{Action: name}
+	for _, s := range sessions {
+		if s.Tab != nil && s.LastModified >= start {
+			rec.SessionIDs = append(rec.SessionIDs, s.ID)
+		}
+	}
+	if before > 0 {
+		if after := countTabs(c); after >= 0 && before > after {
+			rec.Closed = before - after
+		}
+	}
+	if n := rec.lost(); n > 0 {
+		fmt.Printf("Undo can only reopen %d of %s (Firefox remembers the last %d)\n",
+			len(rec.SessionIDs), pluralise(rec.Closed, "closed tab", "closed tabs"), maxUndoTabs)
+	}
+	if len(rec.SessionIDs) == 0 {
+		return nil
+	}
+	if err := wf.Cache.StoreJSON(undoCacheName, rec); err != nil {
+		log.Printf("[ERROR] save undo record: %v", err)
+		return nil
+	}
+	if err := wf.Alfred.RunTrigger(recentTrigger, ""); err != nil {
+		log.Printf("[ERROR] show recently closed: %v", err)
+	}
+	return nil
+}
+
+// filter recently-closed tabs and windows
+func runRecent(_ []string) error {
+	log.Printf("fetching recently-closed for query %q ...", query)
+	checkForUpdate()
+
+	sessions, err := mustClient().RecentlyClosed(0)
+	if err != nil {
+		return err
+	}
+
+	if rec, ok := loadUndo(); ok && query == "" {
+		if n := len(rec.pending(sessions)); n > 0 {
+			sub := "Reopen " + pluralise(n, "tab", "tabs")
+			if rec.lost() > 0 {
+				sub = fmt.Sprintf("Reopen %d of %s · Firefox only remembers the last %d",
+					n, pluralise(rec.Closed, "closed tab", "closed tabs"), maxUndoTabs)
+			}
+			wf.NewItem("Undo "+rec.Action).
+				Subtitle(sub).
+				Valid(true).
+				Icon(iconTab).
+				Var("CMD", "restore").
+				Var("ACTION", "undo")
+		}
+	}
+
+	var missing []string // favicons that need downloading
+	for _, s := range sessions {
+		var (
+			title string
+			sub   = "Closed " + relativeTime(s.Closed())
+			icon  = iconTab
+		)
+		switch {
+		case s.Tab != nil:
+			title = s.Tab.Title
+			sub += " · " + s.Tab.URL
+			if s.Tab.Incognito {
+				icon = iconIncognito
+			} else if fi, ok := favicon(s.Tab.FaviconURL); !ok {
+				missing = append(missing, s.Tab.FaviconURL)
+			} else if fi != nil {
+				icon = fi
+			}
+		case s.Window != nil:
+			title = s.Window.Title
+			if t, ok := s.Window.ActiveTab(); ok && title == "" {
+				title = t.Title
+			}
+			sub += " · Window with " + pluralise(len(s.Window.Tabs), "tab", "tabs")
+			if s.Window.Incognito {
+				icon = iconIncognito
+			}
+		default:
+			continue
+		}
+
+		it := wf.NewItem(title).
+			Subtitle(sub).
+			Match(title).
+			UID(s.ID).
+			Valid(true).
+			Icon(icon).
+			Var("CMD", "restore").
+			Var("ACTION", "restore").
+			Var("SESSION", s.ID)
+
+		if s.Tab != nil {
+			it.Arg(s.Tab.URL).
+				Copytext(s.Tab.URL).
+				NewModifier(aw.ModCmd).
+				Subtitle("Other Actions…").
+				Arg("").
+				Icon(iconMore).
+				Var("CMD", "actions").
+				Var("URL", s.Tab.URL)
+		}
+	}
+	fetchFavicons(missing)
+
+	if query != "" {
+		_ = wf.Filter(query)
+	}
+
+	wf.WarnEmpty("No Recently-Closed Tabs", "Try a different query?")
+	wf.SendFeedback()
+	return nil
+}
+
+// restore a recently-closed tab or window, or undo the last bulk close action
+func runRestore(_ []string) error {
+	useTextErrors()
+	c := mustClient()
+	if action == "undo" {
+		return undoClose(c)
+	}
+	if sessionID == "" {
+		return errors.New("no session ID")
+	}
+
+	log.Printf("restoring session %q ...", sessionID)
+	if _, err := c.RestoreSession(sessionID); err != nil {
+		return err
+	}
+	return activateBrowser(c)
+}
+
+// reopen tabs closed by the last bulk close action
+func undoClose(c *rpcClient) error {
+	rec, ok := loadUndo()
+	if !ok {
+		return errors.New("nothing to undo")
+	}
+	sessions, err := c.RecentlyClosed(0)
+	if err != nil {
+		return err
+	}
+	ids := rec.pending(sessions)
+	log.Printf("undoing %q: restoring %d tab(s) ...", rec.Action, len(ids))
+	// restore least recently closed first, so tabs end up in original order
+	for i := len(ids) - 1; i >= 0; i-- {
+		if _, err := c.RestoreSession(ids[i]); err != nil {
+			return err
+		}
+	}
+	// passing nil deletes the cache file
+	if err := wf.Cache.Store(undoCacheName, nil); err != nil {
+		return err
+	}
+	if rec.lost() > 0 {
+		fmt.Printf("Reopened %d of %s\n", len(ids), pluralise(rec.Closed, "closed tab", "closed tabs"))
+	} else {
+		fmt.Printf("Reopened %s\n", pluralise(len(ids), "tab", "tabs"))
+	}
+	return activateBrowser(c)
+}
+
+// relativeTime returns a human-readable description of how long ago t was.
+func relativeTime(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return pluralise(int(d/time.Minute), "minute", "minutes") + " ago"
+	case d < time.Hour*24:
+		return pluralise(int(d/time.Hour), "hour", "hours") + " ago"
+	default:
+		return pluralise(int(d/(time.Hour*24)), "day", "days") + " ago"
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+var (
+	dedupeFlags  = flag.NewFlagSet("dedupe-tabs", flag.ExitOnError)
+	dedupeDryRun bool // list duplicates instead of closing them
+	dedupeExact  bool // don't normalise URLs
+	// close duplicate tabs
+	dedupeTabsCmd = &ffcli.Command{
+		Name:      "dedupe-tabs",
+		Usage:     "alfred-firefox [-query <query>] dedupe-tabs [-dry-run] [-exact]",
+		ShortHelp: "close duplicate tabs",
+		LongHelp: wrap(`
+			Close tabs that have the same URL as another tab, keeping
+			the most recently used one. Pinned tabs are never closed.
+
+			URLs are compared without their fragment (#...) or trailing
+			slash unless -exact is specified.
+
+			With -dry-run, the duplicates are listed as Alfred items
+			instead of being closed.
+		`),
+		FlagSet: dedupeFlags,
+		Exec:    runDedupeTabs,
+	}
+)
+
+func init() {
+	dedupeFlags.BoolVar(&dedupeDryRun, "dry-run", false, "list duplicate tabs instead of closing them")
+	dedupeFlags.BoolVar(&dedupeExact, "exact", false, "only treat identical URLs as duplicates")
+}
+
+// normaliseURL returns URL without its fragment and trailing slash, and with
+// a lowercase scheme and host, so that equivalent URLs compare equal.
+// Unparseable URLs are returned unchanged.
+func normaliseURL(URL string) string {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return URL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+	return u.String()
+}
+
+// duplicateTabs returns the tabs that duplicate another tab, i.e. all but
+// the most recently accessed tab with each URL. If normalise is true, URLs
+// are compared with normaliseURL. Tabs only duplicate tabs in the same
+// container and private/non-private mode. Pinned tabs are never returned.
+//
+// Duplicates are returned in the same order as in tabs.
+func duplicateTabs(tabs []Tab, normalise bool) []Tab {
+	type key struct {
+		url       string
+		container string
+		incognito bool
+	}
+
+	newest := map[key]Tab{}
+	keys := make([]key, len(tabs))
+	for i, t := range tabs {
+		k := key{t.URL, t.CookieStoreID, t.Incognito}
+		if normalise {
+			k.url = normaliseURL(t.URL)
+		}
+		keys[i] = k
+		if n, ok := newest[k]; !ok || t.LastAccessed > n.LastAccessed {
+			newest[k] = t
+		}
+	}
+
+	var dupes []Tab
+	for i, t := range tabs {
+		if t.Pinned || newest[keys[i]].ID == t.ID {
+			continue
+		}
+		dupes = append(dupes, t)
+	}
+	return dupes
+}
+
+// tabIDs returns the IDs of tabs.
+func tabIDs(tabs []Tab) []int {
+	ids := make([]int, len(tabs))
+	for i, t := range tabs {
+		ids[i] = t.ID
+	}
+	return ids
+}
+
+// Orders for sortTabs.
+const (
+	sortByDomain   = "domain"    // alphabetically by host, ignoring "www."
+	sortByTitle    = "title"     // alphabetically by title
+	sortByLastUsed = "last-used" // most recently used first
+)
+
+// tabHost returns the lowercase host of tab's URL without any "www." prefix.
+func tabHost(t Tab) string { return urlHost(t.URL) }
+
+// urlHost returns the lowercase host of URL without any "www." prefix.
+func urlHost(URL string) string {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// windowTabs returns the tabs in window windowID, sorted by position.
+func windowTabs(tabs []Tab, windowID int) []Tab {
+	var win []Tab
+	for _, t := range tabs {
+		if t.WindowID == windowID {
+			win = append(win, t)
+		}
+	}
+	sort.Slice(win, func(i, j int) bool { return win[i].Index < win[j].Index })
+	return win
+}
+
+// unpinned splits window tabs into unpinned tabs and the number of pinned
+// ones. Pinned tabs always come before unpinned ones, so they are left
+// where they are.
+func unpinned(tabs []Tab) (rest []Tab, pinned int) {
+	for _, t := range tabs {
+		if t.Pinned {
+			pinned++
+		} else {
+			rest = append(rest, t)
+		}
+	}
+	return rest, pinned
+}
+
+// sortTabs returns the IDs of the unpinned tabs in window windowID in the
+// specified order, and the index to move them to, i.e. after the pinned tabs.
+// Tabs that compare equal keep their current order.
+func sortTabs(tabs []Tab, windowID int, order string) (ids []int, index int, err error) {
+	var less func(a, b Tab) bool
+	switch order {
+	case sortByDomain:
+		less = func(a, b Tab) bool { return tabHost(a) < tabHost(b) }
+	case sortByTitle:
+		less = func(a, b Tab) bool { return strings.ToLower(a.Title) < strings.ToLower(b.Title) }
+	case sortByLastUsed:
+		less = func(a, b Tab) bool { return a.LastAccessed > b.LastAccessed }
+	default:
+		return nil, 0, fmt.Errorf("unknown sort order %q", order)
+	}
+
+	win, index := unpinned(windowTabs(tabs, windowID))
+	sort.SliceStable(win, func(i, j int) bool { return less(win[i], win[j]) })
+	return tabIDs(win), index, nil
+}
+
+// gatherTabs returns the IDs of the unpinned tabs in target's window in
+// their new order after moving all tabs with the same host as target from
+// every window to directly after target, and the index to move them to.
+// Tabs in private windows are only gathered into private windows and
+// vice versa, as Firefox can't move tabs between them.
+func gatherTabs(tabs []Tab, target Tab) (ids []int, index int) {
+	var (
+		host     = tabHost(target)
+		gathered []Tab // tabs from other windows, in the order of tabs
+		ordered  []Tab
+	)
+	for _, t := range tabs {
+		if t.WindowID == target.WindowID || t.Pinned || t.Incognito != target.Incognito {
+			continue
+		}
+		if tabHost(t) == host {
+			gathered = append(gathered, t)
+		}
+	}
+
+	win, index := unpinned(windowTabs(tabs, target.WindowID))
+	// tabs from target's window go first, in their current order
+	var same []Tab
+	for _, t := range win {
+		if t.ID != target.ID && tabHost(t) == host {
+			same = append(same, t)
+		}
+	}
+	gathered = append(same, gathered...)
+
+	isGathered := map[int]bool{}
+	for _, t := range gathered {
+		isGathered[t.ID] = true
+	}
+
+	if target.Pinned {
+		// can't put unpinned tabs between pinned ones, so put them first
+		ordered = append(ordered, gathered...)
+	}
+	for _, t := range win {
+		if isGathered[t.ID] {
+			continue
+		}
+		ordered = append(ordered, t)
+		if t.ID == target.ID {
+			ordered = append(ordered, gathered...)
+		}
+	}
+	return tabIDs(ordered), index
+}
+
+// close duplicate tabs or list them
+func runDedupeTabs(_ []string) error {
+	if dedupeDryRun {
+		return listDuplicateTabs()
+	}
+
+	useTextErrors()
+	var (
+		c = mustClient()
+		n int
+	)
+	err := closeWithUndo(c, "Close Duplicate Tabs", func() (err error) {
+		n, err = closeDuplicateTabs(c, !dedupeExact)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		fmt.Println("No duplicate tabs")
+	} else {
+		fmt.Printf("Closed %s\n", pluralise(n, "duplicate tab", "duplicate tabs"))
+	}
+	return nil
+}
+
+// closeDuplicateTabs closes duplicate tabs and returns the number closed.
+func closeDuplicateTabs(c *rpcClient, normalise bool) (int, error) {
+	tabs, err := c.Tabs()
+	if err != nil {
+		return 0, err
+	}
+	dupes := duplicateTabs(tabs, normalise)
+	if len(dupes) == 0 {
+		return 0, nil
+	}
+	log.Printf("closing %d duplicate tab(s) ...", len(dupes))
+	if err := c.CloseTabs(tabIDs(dupes)); err != nil {
+		return 0, err
+	}
+	return len(dupes), nil
+}
+
+// show duplicate tabs that dedupe-tabs would close
+func listDuplicateTabs() error {
+	tabs, err := mustClient().Tabs()
+	if err != nil {
+		return err
+	}
+	dupes := duplicateTabs(tabs, !dedupeExact)
+
+	if query == "" && len(dupes) > 0 {
+		wf.NewItem(fmt.Sprintf("Close %s", pluralise(len(dupes), "Duplicate Tab", "Duplicate Tabs"))).
+			Subtitle("Keep the most recently used tab for each URL").
+			Valid(true).
+			Icon(iconTab).
+			Var("CMD", "dedupe-tabs")
+	}
+
+	for _, t := range dupes {
+		icon := iconTab
+		if t.Incognito {
+			icon = iconIncognito
+		} else if fi, ok := favicon(t.FaviconURL); ok && fi != nil {
+			icon = fi
+		}
+		wf.NewItem(t.Title).
+			Subtitle("↩ to activate · "+t.URL).
+			Match(t.Title+" "+t.URL).
+			Arg(t.URL).
+			UID(fmt.Sprintf("%d", t.ID)).
+			Valid(true).
+			Icon(icon).
+			Var("CMD", "tab").
+			Var("ACTION", "Activate Tab").
+			Var("TAB", fmt.Sprintf("%d", t.ID))
+	}
+
+	if query != "" {
+		_ = wf.Filter(query)
+	}
+
+	wf.WarnEmpty("No Duplicate Tabs", "Every tab has a different URL")
+	wf.SendFeedback()
+	return nil
+}
+
+// sortWindowTabs sorts the tabs in the window containing tab tabID.
+func sortWindowTabs(c *rpcClient, tabID int, order string) error {
+	tab, err := c.Tab(tabID)
+	if err != nil {
+		return err
+	}
+	tabs, err := c.Tabs()
+	if err != nil {
+		return err
+	}
+	ids, index, err := sortTabs(tabs, tab.WindowID, order)
+	if err != nil {
+		return err
+	}
+	log.Printf("sorting %d tab(s) in window %d by %s ...", len(ids), tab.WindowID, order)
+	return c.MoveTabs(ids, tab.WindowID, index)
+}
+
+// gatherDomainTabs moves tabs from the same domain as tab tabID from all
+// windows next to it.
+func gatherDomainTabs(c *rpcClient, tabID int) error {
+	tab, err := c.Tab(tabID)
+	if err != nil {
+		return err
+	}
+	tabs, err := c.Tabs()
+	if err != nil {
+		return err
+	}
+	ids, index := gatherTabs(tabs, tab)
+	log.Printf("gathering tabs from %q in window %d ...", tabHost(tab), tab.WindowID)
+	return c.MoveTabs(ids, tab.WindowID, index)
+}
@@ -0,0 +1,288 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import "testing"
+
+// sameIDs returns true if a and b contain the same IDs in the same order.
+func sameIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// windowOf returns tabs with their WindowID and Index set to place them,
+// in order, in window id.
+func windowOf(id int, tabs ...Tab) []Tab {
+	for i := range tabs {
+		tabs[i].WindowID = id
+		tabs[i].Index = i
+	}
+	return tabs
+}
+
+// join returns the tabs of windows in one slice.
+func join(windows ...[]Tab) []Tab {
+	var tabs []Tab
+	for _, w := range windows {
+		tabs = append(tabs, w...)
+	}
+	return tabs
+}
+
+func TestNormaliseURL(t *testing.T) {
+	tests := []struct {
+		in, x string
+	}{
+		{"https://example.com/", "https://example.com"},
+		{"HTTPS://Example.COM/path/", "https://example.com/path"},
+		{"https://example.com/path#section", "https://example.com/path"},
+		{"https://example.com/Path?q=A", "https://example.com/Path?q=A"},
+		{"about:blank", "about:blank"},
+	}
+	for _, td := range tests {
+		if v := normaliseURL(td.in); v != td.x {
+			t.Errorf("normaliseURL(%q): expected=%q, got=%q", td.in, td.x, v)
+		}
+	}
+}
+
+func TestSortTabs(t *testing.T) {
+	tabs := join(
+		windowOf(1,
+			Tab{ID: 1, URL: "https://zzz.com", Title: "Pinned", Pinned: true, LastAccessed: 50},
+			Tab{ID: 2, URL: "https://www.bbb.com", Title: "beta", LastAccessed: 10},
+			Tab{ID: 3, URL: "https://aaa.com", Title: "Gamma", LastAccessed: 30},
+			Tab{ID: 4, URL: "https://bbb.com/x", Title: "Alpha", LastAccessed: 20},
+		),
+		windowOf(2,
+			Tab{ID: 5, URL: "https://aaa.com", Title: "Other window", LastAccessed: 40},
+		),
+	)
+
+	tests := []struct {
+		order string
+		x     []int
+	}{
+		// pinned tab stays first; www. is ignored; equal hosts keep order
+		{sortByDomain, []int{3, 2, 4}},
+		{sortByTitle, []int{4, 2, 3}},
+		{sortByLastUsed, []int{3, 4, 2}},
+	}
+	for _, td := range tests {
+		td := td
+		t.Run(td.order, func(t *testing.T) {
+			ids, index, err := sortTabs(tabs, 1, td.order)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameIDs(ids, td.x) {
+				t.Errorf("expected=%v, got=%v", td.x, ids)
+			}
+			if index != 1 {
+				t.Errorf("expected index 1 (after pinned tab), got %d", index)
+			}
+		})
+	}
+
+	if _, _, err := sortTabs(tabs, 1, "colour"); err == nil {
+		t.Error("expected error for unknown order")
+	}
+}
+
+func TestGatherTabs(t *testing.T) {
+	tests := []struct {
+		name   string
+		tabs   []Tab
+		target int // ID of target tab
+		x      []int
+		index  int
+	}{
+		{
+			name: "across windows",
+			tabs: join(
+				windowOf(1,
+					Tab{ID: 1, URL: "https://a.com/1"},
+					Tab{ID: 2, URL: "https://b.com"},
+					Tab{ID: 3, URL: "https://www.a.com/2"},
+				),
+				windowOf(2,
+					Tab{ID: 4, URL: "https://a.com/3"},
+					Tab{ID: 5, URL: "https://c.com"},
+				),
+			),
+			target: 1,
+			x:      []int{1, 3, 4, 2},
+		},
+		{
+			name: "target in middle",
+			tabs: join(
+				windowOf(1,
+					Tab{ID: 1, URL: "https://b.com"},
+					Tab{ID: 2, URL: "https://a.com/1"},
+					Tab{ID: 3, URL: "https://c.com"},
+				),
+				windowOf(2, Tab{ID: 4, URL: "https://a.com/2"}),
+			),
+			target: 2,
+			x:      []int{1, 2, 4, 3},
+		},
+		{
+			name: "pinned tabs stay put",
+			tabs: join(
+				windowOf(1,
+					Tab{ID: 1, URL: "https://z.com", Pinned: true},
+					Tab{ID: 2, URL: "https://a.com/1"},
+					Tab{ID: 3, URL: "https://b.com"},
+				),
+				windowOf(2,
+					Tab{ID: 4, URL: "https://a.com/2", Pinned: true},
+					Tab{ID: 5, URL: "https://a.com/3"},
+				),
+			),
+			target: 2,
+			x:      []int{2, 5, 3},
+			index:  1,
+		},
+		{
+			name: "pinned target",
+			tabs: join(
+				windowOf(1,
+					Tab{ID: 1, URL: "https://a.com/1", Pinned: true},
+					Tab{ID: 2, URL: "https://b.com"},
+					Tab{ID: 3, URL: "https://a.com/2"},
+				),
+				windowOf(2, Tab{ID: 4, URL: "https://a.com/3"}),
+			),
+			target: 1,
+			x:      []int{3, 4, 2},
+			index:  1,
+		},
+		{
+			name: "private windows kept separate",
+			tabs: join(
+				windowOf(1,
+					Tab{ID: 1, URL: "https://a.com/1"},
+					Tab{ID: 2, URL: "https://b.com"},
+				),
+				windowOf(2,
+					Tab{ID: 3, URL: "https://a.com/2", Incognito: true},
+				),
+				windowOf(3,
+					Tab{ID: 4, URL: "https://a.com/3"},
+				),
+			),
+			target: 1,
+			x:      []int{1, 4, 2},
+		},
+		{
+			name: "private target",
+			tabs: join(
+				windowOf(1,
+					Tab{ID: 1, URL: "https://a.com/1", Incognito: true},
+				),
+				windowOf(2,
+					Tab{ID: 2, URL: "https://a.com/2"},
+					Tab{ID: 3, URL: "https://a.com/3", Incognito: true},
+				),
+			),
+			target: 1,
+			x:      []int{1, 3},
+		},
+	}
+
+	for _, td := range tests {
+		td := td
+		t.Run(td.name, func(t *testing.T) {
+			var target Tab
+			for _, tab := range td.tabs {
+				if tab.ID == td.target {
+					target = tab
+				}
+			}
+			ids, index := gatherTabs(td.tabs, target)
+			if !sameIDs(ids, td.x) {
+				t.Errorf("expected=%v, got=%v", td.x, ids)
+			}
+			if index != td.index {
+				t.Errorf("expected index %d, got %d", td.index, index)
+			}
+		})
+	}
+}
+
+func TestDuplicateTabs(t *testing.T) {
+	tests := []struct {
+		name      string
+		tabs      []Tab
+		normalise bool
+		x         []int
+	}{
+		{
+			name: "keep most recently used",
+			tabs: []Tab{
+				{ID: 1, URL: "https://a.com", LastAccessed: 10},
+				{ID: 2, URL: "https://a.com", LastAccessed: 30},
+				{ID: 3, URL: "https://a.com", LastAccessed: 20},
+				{ID: 4, URL: "https://b.com", LastAccessed: 5},
+			},
+			x: []int{1, 3},
+		},
+		{
+			name: "exact URLs",
+			tabs: []Tab{
+				{ID: 1, URL: "https://a.com/", LastAccessed: 10},
+				{ID: 2, URL: "https://A.com#top", LastAccessed: 20},
+			},
+		},
+		{
+			name: "normalised URLs",
+			tabs: []Tab{
+				{ID: 1, URL: "https://a.com/", LastAccessed: 10},
+				{ID: 2, URL: "https://A.com#top", LastAccessed: 20},
+			},
+			normalise: true,
+			x:         []int{1},
+		},
+		{
+			name: "containers kept separate",
+			tabs: []Tab{
+				{ID: 1, URL: "https://a.com", LastAccessed: 10},
+				{ID: 2, URL: "https://a.com", LastAccessed: 20, CookieStoreID: "firefox-container-1"},
+				{ID: 3, URL: "https://a.com", LastAccessed: 30, CookieStoreID: "firefox-container-1"},
+			},
+			x: []int{2},
+		},
+		{
+			name: "private tabs kept separate",
+			tabs: []Tab{
+				{ID: 1, URL: "https://a.com", LastAccessed: 10},
+				{ID: 2, URL: "https://a.com", LastAccessed: 20, Incognito: true},
+			},
+		},
+		{
+			name: "pinned tabs never closed",
+			tabs: []Tab{
+				{ID: 1, URL: "https://a.com", LastAccessed: 10, Pinned: true},
+				{ID: 2, URL: "https://a.com", LastAccessed: 20},
+			},
+		},
+	}
+
+	for _, td := range tests {
+		td := td
+		t.Run(td.name, func(t *testing.T) {
+			ids := tabIDs(duplicateTabs(td.tabs, td.normalise))
+			if !sameIDs(ids, td.x) {
+				t.Errorf("expected=%v, got=%v", td.x, ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	aw "github.com/deanishe/awgo"
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+const (
+	visitsMaxPages   = 200 // maximum number of pages on a domain to get visits to
+	visitsMaxResults = 500 // maximum number of visits to show
+)
+
+var (
+	// show visits to a page or domain
+	visitsCmd = &ffcli.Command{
+		Name:      "visits",
+		Usage:     "alfred-firefox -query '<url>|<domain> [since:<time>] [before:<time>]' visits",
+		ShortHelp: "show timeline of visits to a page or domain",
+		LongHelp: wrap(`
+			Show the visits to a URL or to the pages on a domain (and
+			its subdomains), newest first and grouped by day, with how
+			you got to the page, e.g. by following a link or typing
+			the URL.
+		`),
+		Exec: runVisits,
+	}
+
+	// human-readable names of history.TransitionType values
+	transitionNames = map[string]string{
+		"link":              "Link",
+		"typed":             "Typed",
+		"auto_bookmark":     "Bookmark",
+		"auto_subframe":     "Subframe",
+		"manual_subframe":   "Subframe",
+		"generated":         "Search",
+		"auto_toplevel":     "Start Page",
+		"form_submit":       "Form",
+		"reload":            "Reload",
+		"keyword":           "Keyword",
+		"keyword_generated": "Keyword",
+	}
+)
+
+// filterVisits returns the visits between start and end (ms since epoch;
+// 0 = no limit), most recent first.
+func filterVisits(visits []Visit, start, end int64) []Visit {
+	filtered := []Visit{}
+	for _, v := range visits {
+		if (start == 0 || v.VisitTime >= start) && (end == 0 || v.VisitTime < end) {
+			filtered = append(filtered, v)
+		}
+	}
+	sort.SliceStable(filtered, func(i, j int) bool { return filtered[i].VisitTime > filtered[j].VisitTime })
+	return filtered
+}
+
+// parseVisitsQuery parses the query of the visits command: a URL or domain
+// and since: and before: filters. URL is empty if query contains a domain.
+func parseVisitsQuery(q string, now time.Time) (URL string, hq historyQuery, err error) {
+	if hq, err = parseHistoryQuery(q, now); err != nil {
+		return "", hq, err
+	}
+	if strings.Contains(hq.Text, "://") && !strings.ContainsAny(hq.Text, " \t") {
+		URL, hq.Text = hq.Text, ""
+		return URL, hq, nil
+	}
+	hq, err = parseForgetQuery(q, now)
+	return "", hq, err
+}
+
+// visitDay returns the heading for the day of t.
+func visitDay(t, now time.Time) string {
+	const layout = "2006-01-02"
+	switch t.Format(layout) {
+	case now.Format(layout):
+		return "Today"
+	case now.AddDate(0, 0, -1).Format(layout):
+		return "Yesterday"
+	}
+	return t.Format("Monday 2 January 2006")
+}
+
+// transitionName returns a human-readable name for a transition type.
+func transitionName(transition string) string {
+	if s, ok := transitionNames[transition]; ok {
+		return s
+	}
+	return transition
+}
+
+// show visits to a page or domain
+func runVisits(_ []string) error {
+	checkForUpdate()
+	return listVisits()
+}
+
+// show visits to the URL or domain in the query, grouped by day
+func listVisits() error {
+	now := time.Now()
+	URL, hq, err := parseVisitsQuery(query, now)
+	if err != nil {
+		wf.Warn("Invalid Query", err.Error())
+		return nil
+	}
+	if URL == "" && hq.Site == "" {
+		wf.NewItem("Enter a URL or Domain").
+			Subtitle("e.g. example.com since:7d or https://example.com/page").
+			Icon(iconHistory)
+		wf.SendFeedback()
+		return nil
+	}
+
+	arg := hq.arg()
+	log.Printf("fetching visits to %q ...", URL+hq.Site)
+	visits, err := mustClient().Visits(VisitsArg{
+		URL:       URL,
+		Domain:    hq.Site,
+		StartTime: arg.StartTime,
+		EndTime:   arg.EndTime,
+	})
+	if err != nil {
+		return err
+	}
+	if len(visits) > visitsMaxResults {
+		visits = visits[:visitsMaxResults]
+	}
+
+	// count visits per day for headings
+	perDay := map[string]int{}
+	for _, v := range visits {
+		perDay[visitDay(v.Time(), now)]++
+	}
+
+	var (
+		custom = loadCustomActions()
+		day    string
+	)
+	for _, v := range visits {
+		if d := visitDay(v.Time(), now); d != day {
+			day = d
+			wf.NewItem(day).
+				Subtitle(pluralise(perDay[day], "visit", "visits")).
+				Icon(iconHistory)
+		}
+
+		title := v.Title
+		if title == "" {
+			title = v.URL
+		}
+		it := wf.NewItem(v.Time().Format("15:04")+" · "+title).
+			Subtitle(transitionName(v.Transition)+" · "+v.URL).
+			Arg(v.URL).
+			Copytext(v.URL).
+			Valid(true).
+			Icon(iconHistory).
+			Var("CMD", "url").
+			Var("ACTION", urlDefault).
+			Var("URL", v.URL).
+			Var("TITLE", v.Title)
+
+		it.NewModifier(aw.ModCmd).
+			Subtitle("Other Actions…").
+			Arg("").
+			Icon(iconMore).
+			Var("CMD", "actions")
+
+		custom.Add(it, false)
+	}
+
+	wf.WarnEmpty("No Visits", "Try a different URL, domain or time range?")
+	wf.SendFeedback()
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+var (
+	watchFlags  = flag.NewFlagSet("watch", flag.ExitOnError)
+	watchEvents string // comma-separated event names to print
+	// stream browser events
+	watchCmd = &ffcli.Command{
+		Name:      "watch",
+		Usage:     "alfred-firefox watch [-events <name>,...]",
+		ShortHelp: "stream browser events as JSON",
+		LongHelp: wrap(`
+			Print browser events, such as tabs being opened or downloads
+			finishing, as JSON objects, one per line, until interrupted.
+
+			Pass a comma-separated list of event names to -events to
+			only print those events, e.g. -events tab-created,tab-closed.
+			Names ending in "-" match any event with that prefix, e.g.
+			"tab-" matches all tab events.
+			`),
+		FlagSet: watchFlags,
+		Exec:    runWatch,
+	}
+)
+
+func init() {
+	watchFlags.StringVar(&watchEvents, "events", "", "comma-separated names of events to print")
+}
+
+// print browser events as JSON lines
+func runWatch(_ []string) error {
+	useTextErrors()
+	var names []string
+	if watchEvents != "" {
+		names = strings.Split(watchEvents, ",")
+	}
+	// return true if event should be printed
+	wanted := func(ev Event) bool {
+		if len(names) == 0 {
+			return true
+		}
+		for _, s := range names {
+			s = strings.TrimSpace(s)
+			if s == ev.Name || (strings.HasSuffix(s, "-") && strings.HasPrefix(ev.Name, s)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	c := mustClient()
+	enc := json.NewEncoder(os.Stdout)
+	log.Print("watching for browser events ...")
+	for {
+		events, err := c.Events(30)
+		if err != nil {
+			return err
+		}
+		for _, ev := range events {
+			if !wanted(ev) {
+				continue
+			}
+			if err := enc.Encode(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
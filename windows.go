@@ -0,0 +1,154 @@
+// Copyright (c) 2020 Dean Jackson <deanishe@deanishe.net>
+// MIT Licence applies http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	aw "github.com/deanishe/awgo"
+	"github.com/deanishe/awgo/util"
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+var (
+	// filter browser windows
+	windowsCmd = &ffcli.Command{
+		Name:      "windows",
+		Usage:     "alfred-firefox [-query <query>] windows",
+		ShortHelp: "filter browser windows",
+		LongHelp:  wrap(`Filter browser windows and focus, minimise or close them.`),
+		Exec:      runWindows,
+	}
+
+	// run a window action
+	windowCmd = &ffcli.Command{
+		Name:      "window",
+		Usage:     "alfred-firefox -window <id> -action focus|minimize|close window",
+		ShortHelp: "execute window action",
+		LongHelp:  wrap(`Focus, minimise or close the specified window.`),
+		Exec:      runWindowAction,
+	}
+)
+
+// filter browser windows
+func runWindows(_ []string) error {
+	log.Printf("fetching windows for query %q ...", query)
+	checkForUpdate()
+
+	windows, err := mustClient().Windows()
+	if err != nil {
+		return err
+	}
+
+	for _, w := range windows {
+		var (
+			id    = fmt.Sprintf("%d", w.ID)
+			icon  = iconTab
+			title = w.Title
+			info  = []string{pluralise(len(w.Tabs), "tab", "tabs")}
+		)
+		if t, ok := w.ActiveTab(); ok && title == "" {
+			title = t.Title
+		}
+		if w.Focused {
+			info = append(info, "current window")
+		}
+		if w.Incognito {
+			icon = iconIncognito
+			info = append(info, "private")
+		}
+		if w.State == "minimized" {
+			info = append(info, "minimised")
+		}
+
+		it := wf.NewItem(title).
+			Subtitle(strings.Join(info, " · ")).
+			Match(title).
+			Arg(id).
+			UID(id).
+			Valid(true).
+			Icon(icon).
+			Var("CMD", "window").
+			Var("ACTION", "focus").
+			Var("WINDOW", id)
+
+		it.NewModifier(aw.ModCmd).
+			Subtitle("Close window and its tabs").
+			Var("ACTION", "close")
+
+		it.NewModifier(aw.ModOpt).
+			Subtitle("Minimise window").
+			Var("ACTION", "minimize")
+	}
+
+	if query != "" {
+		_ = wf.Filter(query)
+	}
+
+	wf.WarnEmpty("No Matching Windows", "Try a different query?")
+	wf.SendFeedback()
+	return nil
+}
+
+// focus, minimise or close the given window
+func runWindowAction(_ []string) error {
+	useTextErrors()
+	if windowID == 0 {
+		return errors.New("no window ID")
+	}
+
+	log.Printf("running action %q on window #%d ...", action, windowID)
+	c := mustClient()
+	switch action {
+	case "focus":
+		name, err := c.AppName()
+		if err != nil {
+			return err
+		}
+		if _, err := util.RunAS(fmt.Sprintf(`tell application "%s" to activate`, name)); err != nil {
+			return err
+		}
+		return c.FocusWindow(windowID)
+	case "minimize":
+		return c.MinimizeWindow(windowID)
+	case "close":
+		return c.CloseWindow(windowID)
+	default:
+		return fmt.Errorf("unknown window action %q", action)
+	}
+}
+
+// list windows to move tab to or open URL in
+func pickWindow() error {
+	c := mustClient()
+	tab, isTab, err := pickerTab(c)
+	if err != nil {
+		return err
+	}
+	windows, err := c.Windows()
+	if err != nil {
+		return err
+	}
+
+	if isTab {
+		pickerItem("New Window", "Move tab to a new window", "0", iconTab).Var("WINDOW", "0")
+	} else {
+		pickerItem("New Window", "Open URL in a new window", "0", iconTab).Var("WINDOW", "0")
+	}
+	for _, w := range windows {
+		if isTab && w.ID == tab.WindowID {
+			continue
+		}
+		icon := iconTab
+		if w.Incognito {
+			icon = iconIncognito
+		}
+		id := fmt.Sprintf("%d", w.ID)
+		pickerItem(w.Title, pluralise(len(w.Tabs), "tab", "tabs"), id, icon).Var("WINDOW", id)
+	}
+	return nil
+}